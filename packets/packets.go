@@ -185,9 +185,40 @@ func NewControlPacket(t PacketType) *ControlPacket {
 	return cp
 }
 
+// PacketTooLargeError is returned when a control packet exceeds the
+// maximum packet size allowed, either when reading it with ReadPacketLimit
+// or before sending it to a peer that advertised a Maximum Packet Size.
+type PacketTooLargeError struct {
+	Type  PacketType
+	Size  int
+	Limit uint32
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("%s packet of %d bytes exceeds maximum packet size of %d", e.Type, e.Size, e.Limit)
+}
+
+// PacketSize returns the number of bytes p takes on the wire, including
+// the fixed header
+func PacketSize(p Packet) int {
+	var n int
+	for _, b := range p.Buffers() {
+		n += len(b)
+	}
+	return 1 + len(encodeVBI(n)) + n
+}
+
 // ReadPacket reads a control packet from a io.Reader and returns a completed
 // struct with the appropriate data
 func ReadPacket(r io.Reader) (*ControlPacket, error) {
+	return ReadPacketLimit(r, 0)
+}
+
+// ReadPacketLimit is like ReadPacket but returns a *PacketTooLargeError,
+// before reading or allocating space for the rest of the packet, if the
+// fixed header announces a packet bigger than limit bytes in total.
+// A limit of 0 means no limit.
+func ReadPacketLimit(r io.Reader, limit uint32) (*ControlPacket, error) {
 	t := [1]byte{}
 	_, err := io.ReadFull(r, t[:])
 	if err != nil {
@@ -200,15 +231,21 @@ func ReadPacket(r io.Reader) (*ControlPacket, error) {
 	cp.Flags = t[0] & 0xF
 	if cp.Type == PUBLISH {
 		cp.Content.(*Publish).QoS = (cp.Flags & 0x6) >> 1
+		cp.Content.(*Publish).Duplicate = cp.Flags&0x8 != 0
+		cp.Content.(*Publish).Retain = cp.Flags&0x1 != 0
 	}
 	vbi, err := getVBI(r)
 	if err != nil {
 		return nil, err
 	}
+	vbiLen := vbi.Len()
 	cp.remainingLength, err = decodeVBI(vbi)
 	if err != nil {
 		return nil, err
 	}
+	if size := 1 + vbiLen + cp.remainingLength; limit > 0 && size > int(limit) {
+		return nil, &PacketTooLargeError{Type: cp.Type, Size: size, Limit: limit}
+	}
 
 	var content bytes.Buffer
 	content.Grow(cp.remainingLength)
@@ -275,6 +312,9 @@ func getVBI(r io.Reader) (*bytes.Buffer, error) {
 		if digit[0] <= 0x7f {
 			return &ret, nil
 		}
+		if ret.Len() == 4 {
+			return nil, fmt.Errorf("malformed variable byte integer, more than 4 bytes")
+		}
 	}
 }
 
@@ -135,6 +135,34 @@ func TestReadPacketConnect(t *testing.T) {
 	assert.Equal(t, uint32(30), *c.Content.(*Connect).Properties.SessionExpiryInterval)
 }
 
+func TestReadPacketLimit(t *testing.T) {
+	p := []byte{16, 38, 0, 4, 77, 81, 84, 84, 5, 128, 0, 30, 5, 17, 0, 0, 0, 30, 0, 10, 116, 101, 115, 116, 67, 108, 105, 101, 110, 116, 0, 8, 116, 101, 115, 116, 85, 115, 101, 114}
+
+	_, err := ReadPacketLimit(bytes.NewReader(p), 40)
+	require.Nil(t, err)
+
+	_, err = ReadPacketLimit(bytes.NewReader(p), 39)
+	require.IsType(t, &PacketTooLargeError{}, err)
+	assert.Equal(t, &PacketTooLargeError{Type: CONNECT, Size: 40, Limit: 39}, err)
+
+	_, err = ReadPacket(bytes.NewReader([]byte{48, 0xff, 0xff, 0xff, 0xff, 0x7f}))
+	assert.NotNil(t, err)
+}
+
+func TestPacketSize(t *testing.T) {
+	p := &Publish{
+		Topic:      "test/1",
+		QoS:        1,
+		PacketID:   1,
+		Payload:    make([]byte, 200),
+		Properties: &Properties{},
+	}
+	var b bytes.Buffer
+	_, err := p.WriteTo(&b)
+	require.Nil(t, err)
+	assert.Equal(t, b.Len(), PacketSize(p))
+}
+
 func TestReadStringWriteString(t *testing.T) {
 	var b bytes.Buffer
 	writeString("Test string", &b)
@@ -58,9 +58,9 @@ type Properties struct {
 	// CorrelationData is binary data used to associate future response
 	// messages with the original request message
 	CorrelationData []byte
-	// SubscriptionIdentifier is an identifier of the subscription to which
-	// the Publish matched
-	SubscriptionIdentifier *uint32
+	// SubscriptionIdentifiers are the identifiers of the subscriptions to
+	// which the Publish matched, a Subscribe carries at most one
+	SubscriptionIdentifiers []uint32
 	// SessionExpiryInterval is the time in seconds after a client disconnects
 	// that the server should retain the session information (subscriptions etc)
 	SessionExpiryInterval *uint32
@@ -173,9 +173,9 @@ func (i *Properties) Pack(p PacketType) []byte {
 	}
 
 	if p == PUBLISH || p == SUBSCRIBE {
-		if i.SubscriptionIdentifier != nil {
+		for _, si := range i.SubscriptionIdentifiers {
 			b.WriteByte(PropSubscriptionIdentifier)
-			writeUint32(*i.SubscriptionIdentifier, &b)
+			b.Write(encodeVBI(int(si)))
 		}
 	}
 
@@ -357,11 +357,18 @@ func (i *Properties) Unpack(r *bytes.Buffer, p PacketType) error {
 			}
 			i.CorrelationData = cd
 		case PropSubscriptionIdentifier:
-			si, err := readUint32(buf)
+			vbi, err := getVBI(buf)
 			if err != nil {
 				return err
 			}
-			i.SubscriptionIdentifier = &si
+			si, err := decodeVBI(vbi)
+			if err != nil {
+				return err
+			}
+			if si == 0 {
+				return fmt.Errorf("invalid subscription identifier 0")
+			}
+			i.SubscriptionIdentifiers = append(i.SubscriptionIdentifiers, uint32(si))
 		case PropSessionExpiryInterval:
 			se, err := readUint32(buf)
 			if err != nil {
@@ -1,7 +1,9 @@
 package packets
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -141,6 +143,32 @@ func TestInvalidPropertiess(t *testing.T) {
 	}
 }
 
+func TestSubscriptionIdentifiers(t *testing.T) {
+	p := &Properties{SubscriptionIdentifiers: []uint32{1, 200, 268435455}}
+	b := p.Pack(PUBLISH)
+	// Each identifier is a Variable Byte Integer following its property id.
+	if want := 3 + 1 + 2 + 4; len(b) != want {
+		t.Fatalf("packed properties are %d bytes, want %d", len(b), want)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encodeVBI(len(b)))
+	buf.Write(b)
+	var got Properties
+	if err := got.Unpack(&buf, PUBLISH); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.SubscriptionIdentifiers, got.SubscriptionIdentifiers) {
+		t.Fatalf("unpacked %v, want %v", got.SubscriptionIdentifiers, p.SubscriptionIdentifiers)
+	}
+
+	buf.Reset()
+	buf.Write([]byte{2, PropSubscriptionIdentifier, 0})
+	if err := got.Unpack(&buf, PUBLISH); err == nil {
+		t.Fatalf("subscription identifier 0 accepted")
+	}
+}
+
 func BenchmarkPropertyCreationStruct(b *testing.B) {
 	var p *Properties
 	pf := byte(1)
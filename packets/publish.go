@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"time"
 )
 
 // Publish is the Variable Header definition for a publish control packet
@@ -16,6 +17,9 @@ type Publish struct {
 	QoS        byte
 	Duplicate  bool
 	Retain     bool
+	// ReceivedAt is the time the client read the Publish from the network,
+	// it is not part of the packet and zero for the Publishes it sends.
+	ReceivedAt time.Time
 }
 
 //Unpack is the implementation of the interface required function for a packet
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"sort"
 )
 
 // Subscribe is the Variable Header definition for a Subscribe control packet
@@ -79,12 +80,25 @@ func (s *Subscribe) Unpack(r *bytes.Buffer) error {
 	return nil
 }
 
+// Topics returns the topic filters of the Subscribe sorted, which is the
+// order they are sent in and so the order of the reason codes in the
+// Suback.
+func (s *Subscribe) Topics() []string {
+	topics := make([]string, 0, len(s.Subscriptions))
+	for t := range s.Subscriptions {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 // Buffers is the implementation of the interface required function for a packet
 func (s *Subscribe) Buffers() net.Buffers {
 	var b bytes.Buffer
 	writeUint16(s.PacketID, &b)
 	var subs bytes.Buffer
-	for t, o := range s.Subscriptions {
+	for _, t := range s.Topics() {
+		o := s.Subscriptions[t]
 		writeString(t, &subs)
 		subs.WriteByte(o.Pack())
 	}
@@ -0,0 +1,155 @@
+package paho
+
+import (
+	"sync"
+	"time"
+)
+
+// AckMode determines when the Pubacks and Pubrecs acknowledging received
+// Publishes are sent.
+//
+// In the AckOrdered and AckAuto modes an acknowledgement is sent by
+// whichever goroutine releases it, so ack always returns nil. The errors
+// writing acknowledgements are logged instead, the Client failing along
+// with its connection anyway, see Client.Err.
+type AckMode int
+
+const (
+	// AckManual sends the acknowledgement as soon as the Router calls
+	// ack, so acknowledgements may be sent in any order. It is the
+	// default.
+	AckManual AckMode = iota
+	// AckOrdered holds back the acknowledgement of a Publish, once the
+	// Router has called ack, until all the Publishes received before it
+	// have been acknowledged, as required by section 4.6 of the MQTT v5
+	// specification.
+	AckOrdered
+	// AckAuto acknowledges every Publish once Route returns, unless the
+	// Router called ack before, in the order they were received.
+	AckAuto
+)
+
+// DefaultAckTimeout is the time after which, in the AckOrdered and AckAuto
+// modes, a Publish the Router has not acknowledged is acknowledged anyway
+// so that it does not hold back the others, when ClientConfig.AckTimeout
+// is not set.
+var DefaultAckTimeout = 30 * time.Second
+
+// ackSequencer sends acknowledgements in the order their Publishes were
+// received.
+type ackSequencer struct {
+	timeout   time.Duration
+	onTimeout func(id uint16)
+	// onError, if set, is called with the errors sending the
+	// acknowledgements, which are not returned to the Router.
+	onError func(id uint16, err error)
+
+	mu      sync.Mutex
+	pending []*pendingAck
+	// out holds the acknowledgements no longer held back, which are sent
+	// by a single goroutine at a time, the flusher, without holding mu.
+	out      []*pendingAck
+	flushing bool
+	closed   bool
+}
+
+type pendingAck struct {
+	id    uint16
+	send  func() error
+	ready bool
+	timer *time.Timer
+}
+
+// add queues send, which writes the acknowledgement of the Publish with
+// packet identifier id, behind those of the Publishes received earlier.
+// It returns the ack function to hand to the Router; send is called once
+// ack has been called for this and all the earlier Publishes, or once the
+// timeout has expired, if any.
+func (s *ackSequencer) add(id uint16, send func() error) func() error {
+	p := &pendingAck{id: id, send: send}
+	s.mu.Lock()
+	s.pending = append(s.pending, p)
+	if s.timeout > 0 && !s.closed {
+		p.timer = time.AfterFunc(s.timeout, func() {
+			s.mu.Lock()
+			expired := !p.ready && !s.closed
+			s.mu.Unlock()
+			if expired && s.onTimeout != nil {
+				s.onTimeout(p.id)
+			}
+			s.ready(p)
+		})
+	}
+	s.mu.Unlock()
+
+	return func() error {
+		s.ready(p)
+		return nil
+	}
+}
+
+// ready marks p as acknowledged by the Router and sends the
+// acknowledgements no longer held back by an earlier one. If another
+// goroutine is already sending acknowledgements, it sends these too and
+// ready returns without waiting for them.
+func (s *ackSequencer) ready(p *pendingAck) {
+	s.mu.Lock()
+	if p.ready || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	p.ready = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	for len(s.pending) > 0 && s.pending[0].ready {
+		s.out = append(s.out, s.pending[0])
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+	}
+	if s.flushing {
+		s.mu.Unlock()
+		return
+	}
+	s.flushing = true
+	s.mu.Unlock()
+
+	s.flush()
+}
+
+// flush sends the acknowledgements of out until there are none left, it
+// is only run by the flusher.
+func (s *ackSequencer) flush() {
+	for {
+		s.mu.Lock()
+		out := s.out
+		s.out = nil
+		if len(out) == 0 || s.closed {
+			s.flushing = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		for _, p := range out {
+			if err := p.send(); err != nil && s.onError != nil {
+				s.onError(p.id, err)
+			}
+		}
+	}
+}
+
+// close stops the timers of the pending acknowledgements, which are not
+// sent anymore.
+func (s *ackSequencer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, p := range s.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	s.pending = nil
+	s.out = nil
+}
@@ -0,0 +1,84 @@
+package paho
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAckSequencerSendUnlocked(t *testing.T) {
+	var s ackSequencer
+	sent := make(chan uint16, 3)
+	blocked := make(chan struct{})
+	unblock := make(chan struct{})
+	send := func(id uint16) func() error {
+		return func() error {
+			if id == 1 {
+				close(blocked)
+				<-unblock
+			}
+			sent <- id
+			return nil
+		}
+	}
+
+	ack1 := s.add(1, send(1))
+	go func() {
+		_ = ack1()
+	}()
+	<-blocked
+
+	// The sequencer stays usable while an acknowledgement is being
+	// written, the later ones being sent in order by the flusher.
+	ack2 := s.add(2, send(2))
+	ack3 := s.add(3, send(3))
+	require.NoError(t, ack3())
+	require.NoError(t, ack2())
+	close(unblock)
+
+	for _, id := range []uint16{1, 2, 3} {
+		assert.Equal(t, id, <-sent)
+	}
+}
+
+func TestAckSequencerErrors(t *testing.T) {
+	var failed []uint16
+	s := ackSequencer{
+		onError: func(id uint16, err error) {
+			assert.Equal(t, ErrClosed, err)
+			failed = append(failed, id)
+		},
+	}
+	ack1 := s.add(1, func() error { return ErrClosed })
+	ack2 := s.add(2, func() error { return nil })
+
+	// Errors are reported whichever goroutine sends the acknowledgement,
+	// not to the caller of ack.
+	assert.NoError(t, ack2())
+	assert.NoError(t, ack1())
+	assert.Equal(t, []uint16{1}, failed)
+}
+
+func TestAckSequencerClose(t *testing.T) {
+	timeouts := make(chan uint16, 1)
+	s := ackSequencer{
+		timeout: 20 * time.Millisecond,
+		onTimeout: func(id uint16) {
+			timeouts <- id
+		},
+	}
+	ack := s.add(1, func() error {
+		t.Error("acknowledgement sent after close")
+		return nil
+	})
+	s.close()
+
+	select {
+	case id := <-timeouts:
+		t.Fatalf("timer of %d fired after close", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(t, ack())
+}
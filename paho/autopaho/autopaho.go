@@ -0,0 +1,331 @@
+package autopaho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/transport"
+)
+
+// DefaultConnectTimeout is the time allowed for dialing the broker and
+// completing the CONNECT/CONNACK exchange when ClientConfig.ConnectTimeout
+// is not set.
+var DefaultConnectTimeout = 10 * time.Second
+
+// ErrConnectionManagerClosed is returned when an operation is attempted on
+// a ConnectionManager that has been shut down.
+var ErrConnectionManagerClosed = errors.New("autopaho: connection manager closed")
+
+type (
+	// ClientConfig adds the values needed to (re)establish connections to
+	// the standard paho.ClientConfig. A new paho.Client is built from the
+	// embedded ClientConfig for every connection attempt, its Conn field
+	// is ignored and replaced with the result of Dial.
+	ClientConfig struct {
+		// Dial is called to obtain a fresh network connection to the
+		// server before every connection attempt. If it is nil the
+		// connection is made to one of BrokerURLs using Dialer.
+		Dial func(context.Context) (net.Conn, error)
+		// BrokerURLs are the servers to connect to, they are tried in the
+		// order set by Failover on every connection attempt until one of
+		// them accepts the connection.
+		BrokerURLs []*url.URL
+		// Dialer is used to connect to BrokerURLs, a zero
+		// transport.Dialer is used if it is nil.
+		Dialer *transport.Dialer
+		// Failover determines the order in which BrokerURLs are tried.
+		Failover Failover
+		// MaxRedirects limits the number of consecutive server references,
+		// sent with the Use another server and Server moved reason codes,
+		// that are followed; DefaultMaxRedirects is used if it is zero and
+		// a negative value disables them. Server references are only
+		// followed when connecting to BrokerURLs.
+		MaxRedirects int
+		// Connect is the template for the CONNECT packet sent on every
+		// connection attempt.
+		Connect *paho.Connect
+		// ConnectTimeout limits the time spent in Dial and waiting for the
+		// CONNACK on each attempt.
+		ConnectTimeout time.Duration
+		// Backoff determines the delay between failed connection attempts.
+		Backoff Backoff
+
+		// OnConnectionUp is called every time a connection has been
+		// established, with the CONNACK received from the server.
+		OnConnectionUp func(*ConnectionManager, *paho.Connack)
+		// OnConnectionDown is called every time an established connection
+		// is lost, with the error the client was closed with, see
+		// paho.Client.Err; it is a *paho.DisconnectError when the server
+		// sent a Disconnect. It is not called when the manager is shut
+		// down.
+		OnConnectionDown func(error)
+		// OnConnectError is called whenever a connection attempt fails.
+		OnConnectError func(error)
+		// OnResubscribeError is called for every recorded topic filter
+		// which could not be subscribed to again on a new connection. err
+		// is a *paho.ReasonError if the server refused the subscription,
+		// in which case the filter is no longer recorded.
+		OnResubscribeError func(topic string, err error)
+
+		paho.ClientConfig
+	}
+
+	// ConnectionManager keeps a connection to the server alive, creating a
+	// new paho.Client whenever the previous one is lost.
+	ConnectionManager struct {
+		cfg ClientConfig
+
+		mu     sync.Mutex
+		cli    *paho.Client
+		connUp chan struct{} // closed while cli is live.
+		// subs are the topic filters subscribed to, by filter.
+		subs map[string]*subscription
+
+		// The following are only used by the manage goroutine to choose
+		// the server of the next connection attempt.
+		urls      []*url.URL
+		next      int
+		current   *url.URL
+		redirect  *url.URL
+		redirects int
+		// failed is set while connection attempts fail, so that the next
+		// one starts with the URL following the last one tried.
+		failed bool
+
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+)
+
+// NewConnection starts managing a connection described by cfg and returns
+// immediately; use AwaitConnection to wait until the first connection has
+// been established. The connection is maintained until ctx is canceled or
+// Disconnect is called.
+func NewConnection(ctx context.Context, cfg ClientConfig) (*ConnectionManager, error) {
+	if cfg.Dial == nil && len(cfg.BrokerURLs) == 0 {
+		return nil, fmt.Errorf("autopaho: Dial or BrokerURLs must be set")
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = new(transport.Dialer)
+	}
+	if cfg.MaxRedirects == 0 {
+		cfg.MaxRedirects = DefaultMaxRedirects
+	}
+	if cfg.Connect == nil {
+		cfg.Connect = new(paho.Connect)
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.Backoff == nil {
+		cfg.Backoff = DefaultBackoff
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c := &ConnectionManager{
+		cfg:    cfg,
+		connUp: make(chan struct{}),
+		subs:   make(map[string]*subscription),
+		cancel: cancel,
+		done:   make(chan struct{}),
+		urls:   append([]*url.URL(nil), cfg.BrokerURLs...),
+	}
+	if c.cfg.Dial == nil {
+		c.cfg.Dial = c.dial
+	}
+	go c.manage(ctx)
+
+	return c, nil
+}
+
+// manage is the goroutine responsible for (re)establishing the connection,
+// it exits when ctx is canceled.
+func (c *ConnectionManager) manage(ctx context.Context) {
+	defer close(c.done)
+
+	var attempt int
+	for {
+		cli, ca, err := c.attemptConnection(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.log(paho.LevelWarn, "connection attempt failed", err)
+			if c.cfg.OnConnectError != nil {
+				c.cfg.OnConnectError(err)
+			}
+			c.failed = true
+			if ca != nil && ca.Properties != nil && c.followReference(ca.ReasonCode, ca.Properties.ServerReference) {
+				continue
+			}
+			c.redirects = 0
+			if !sleep(ctx, c.cfg.Backoff(attempt)) {
+				return
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		c.failed = false
+		c.redirects = 0
+
+		c.mu.Lock()
+		c.cli = cli
+		close(c.connUp)
+		c.mu.Unlock()
+
+		c.log(paho.LevelDebug, "connection up", nil)
+		if !ca.SessionPresent {
+			var maxPacketSize uint32
+			if ca.Properties != nil && ca.Properties.MaximumPacketSize != nil {
+				maxPacketSize = *ca.Properties.MaximumPacketSize
+			}
+			c.resubscribe(ctx, cli, maxPacketSize)
+		}
+		if c.cfg.OnConnectionUp != nil {
+			c.cfg.OnConnectionUp(c, ca)
+		}
+
+		var shutdown bool
+		select {
+		case <-cli.Done():
+		case <-ctx.Done():
+			shutdown = true
+		}
+
+		c.mu.Lock()
+		c.cli = nil
+		c.connUp = make(chan struct{})
+		c.mu.Unlock()
+
+		if shutdown {
+			sctx, cf := context.WithTimeout(context.Background(), cli.ShutdownTimeout)
+			cli.Shutdown(sctx)
+			cf()
+			return
+		}
+
+		c.log(paho.LevelDebug, "connection down", cli.Err())
+		if c.cfg.OnConnectionDown != nil {
+			c.cfg.OnConnectionDown(cli.Err())
+		}
+		var derr *paho.DisconnectError
+		if errors.As(cli.Err(), &derr) {
+			d := derr.Disconnect
+			if d.Properties != nil && c.followReference(d.ReasonCode, d.Properties.ServerReference) {
+				continue
+			}
+		}
+		if !sleep(ctx, c.cfg.Backoff(attempt)) {
+			return
+		}
+	}
+}
+
+// attemptConnection dials the server and performs the CONNECT/CONNACK
+// exchange on a brand new paho.Client.
+func (c *ConnectionManager) attemptConnection(ctx context.Context) (*paho.Client, *paho.Connack, error) {
+	ctx, cf := context.WithTimeout(ctx, c.cfg.ConnectTimeout)
+	defer cf()
+
+	conn, err := c.cfg.Dial(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial error: %w", err)
+	}
+
+	cfg := c.cfg.ClientConfig
+	cfg.Conn = conn
+	cli := paho.NewClient(cfg)
+
+	ca, err := cli.Connect(ctx, c.cfg.Connect)
+	if err != nil {
+		return nil, ca, err
+	}
+	return cli, ca, nil
+}
+
+// AwaitConnection blocks until a connection to the server is established,
+// ctx is done or the ConnectionManager is shut down.
+func (c *ConnectionManager) AwaitConnection(ctx context.Context) error {
+	_, err := c.awaitClient(ctx)
+	return err
+}
+
+func (c *ConnectionManager) awaitClient(ctx context.Context) (*paho.Client, error) {
+	for {
+		c.mu.Lock()
+		cli, connUp := c.cli, c.connUp
+		c.mu.Unlock()
+		if cli != nil {
+			return cli, nil
+		}
+
+		select {
+		case <-connUp:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.done:
+			return nil, ErrConnectionManagerClosed
+		}
+	}
+}
+
+// Publish waits for a live connection and then publishes p on it. If the
+// connection is lost while waiting for the acknowledgement an error is
+// returned; the message is not automatically resent.
+func (c *ConnectionManager) Publish(ctx context.Context, p *paho.Publish) (*paho.PublishResponse, error) {
+	cli, err := c.awaitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cli.Publish(ctx, p)
+}
+
+// Disconnect stops reconnecting and gracefully closes the current
+// connection, if any. It returns once the ConnectionManager has shut down
+// or ctx is done.
+func (c *ConnectionManager) Disconnect(ctx context.Context) error {
+	c.cancel()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done returns a channel that is closed when the ConnectionManager has
+// shut down.
+func (c *ConnectionManager) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *ConnectionManager) log(level paho.LogLevel, msg string, err error) {
+	fn := c.cfg.Logger
+	if fn == nil {
+		return
+	}
+	fn(context.Background(), paho.LogEntry{
+		Level:   level,
+		Message: "autopaho: " + msg,
+		Error:   err,
+	})
+}
+
+// sleep waits for d and reports false if ctx was done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
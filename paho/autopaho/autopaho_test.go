@@ -0,0 +1,603 @@
+package autopaho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+)
+
+// fakeBroker hands out in-memory connections and answers CONNECT, QoS 1
+// PUBLISH, SUBSCRIBE and UNSUBSCRIBE packets received on them.
+type fakeBroker struct {
+	mu        sync.Mutex
+	conns     []net.Conn
+	connacks  []byte // reason codes to answer successive CONNECTs with.
+	reference string // server reference sent with failed CONNACKs.
+
+	maxPacketSize uint32          // sent in CONNACKs if set.
+	deny          map[string]bool // topic filters refused with 0x87.
+	subscribes    [][]string      // topic filters of each SUBSCRIBE.
+}
+
+func (b *fakeBroker) Dial(context.Context) (net.Conn, error) {
+	server, client := net.Pipe()
+	go b.serve(server)
+
+	return client, nil
+}
+
+// Listen serves connections made to the returned URL until the test ends.
+func (b *fakeBroker) Listen(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return &url.URL{Scheme: "mqtt", Host: l.Addr().String()}
+}
+
+// Conns returns the number of connections made to the broker.
+func (b *fakeBroker) Conns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// Refuse sets the reason codes of the CONNACKs sent to the next
+// connections, and the server reference sent with them.
+func (b *fakeBroker) Refuse(codes []byte, reference string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connacks, b.reference = codes, reference
+}
+
+// accept records conn and returns the reason code and server reference of
+// the CONNACK to send on it.
+func (b *fakeBroker) accept(conn net.Conn) (byte, string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns = append(b.conns, conn)
+	var code byte
+	if len(b.connacks) > 0 {
+		code, b.connacks = b.connacks[0], b.connacks[1:]
+	}
+	return code, b.reference
+}
+
+// Redirect sends a DISCONNECT with the given reason code and server
+// reference on the most recent connection.
+func (b *fakeBroker) Redirect(code byte, reference string) error {
+	b.mu.Lock()
+	conn := b.conns[len(b.conns)-1]
+	b.mu.Unlock()
+	d := packets.Disconnect{ReasonCode: code, Properties: &packets.Properties{ServerReference: reference}}
+	_, err := d.WriteTo(conn)
+	return err
+}
+
+// Drop closes the most recent connection handed out by Dial.
+func (b *fakeBroker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns[len(b.conns)-1].Close()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	code, reference := b.accept(conn)
+	defer conn.Close()
+	for {
+		recv, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch recv.Type {
+		case packets.CONNECT:
+			ca := packets.Connack{ReasonCode: code, Properties: &packets.Properties{}}
+			if code >= 0x80 {
+				ca.Properties.ServerReference = reference
+			}
+			if max := b.MaxPacketSize(); max > 0 {
+				ca.Properties.MaximumPacketSize = &max
+			}
+			if _, err := ca.WriteTo(conn); err != nil || code >= 0x80 {
+				return
+			}
+		case packets.PUBLISH:
+			pa := packets.Puback{PacketID: recv.PacketID(), Properties: &packets.Properties{}}
+			if _, err := pa.WriteTo(conn); err != nil {
+				return
+			}
+		case packets.SUBSCRIBE:
+			sa := packets.Suback{PacketID: recv.PacketID(), Properties: &packets.Properties{}}
+			sa.Reasons = b.subscribe(recv.Content.(*packets.Subscribe))
+			if _, err := sa.WriteTo(conn); err != nil {
+				return
+			}
+		case packets.UNSUBSCRIBE:
+			u := recv.Content.(*packets.Unsubscribe)
+			ua := packets.Unsuback{
+				PacketID:   recv.PacketID(),
+				Reasons:    make([]byte, len(u.Topics)),
+				Properties: &packets.Properties{},
+			}
+			if _, err := ua.WriteTo(conn); err != nil {
+				return
+			}
+		case packets.DISCONNECT:
+			return
+		}
+	}
+}
+
+// MaxPacketSize returns the Maximum Packet Size sent in CONNACKs.
+func (b *fakeBroker) MaxPacketSize() uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.maxPacketSize
+}
+
+// Subscribes returns the topic filters of every SUBSCRIBE received.
+func (b *fakeBroker) Subscribes() [][]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([][]string(nil), b.subscribes...)
+}
+
+// subscribe records s and returns the reason codes to answer it with.
+func (b *fakeBroker) subscribe(s *packets.Subscribe) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	topics := s.Topics()
+	b.subscribes = append(b.subscribes, topics)
+	reasons := make([]byte, len(topics))
+	for i, t := range topics {
+		reasons[i] = s.Subscriptions[t].QoS
+		if b.deny[t] {
+			reasons[i] = 0x87
+		}
+	}
+	return reasons
+}
+
+func TestConnectionManagerReconnects(t *testing.T) {
+	b := &fakeBroker{connacks: []byte{0x87}}
+
+	ups := make(chan struct{}, 2)
+	downs := make(chan error, 1)
+	connectErrors := make(chan error, 1)
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		Dial:    b.Dial,
+		Backoff: NewConstantBackoff(time.Millisecond),
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+			ups <- struct{}{}
+		},
+		OnConnectionDown: func(err error) {
+			downs <- err
+		},
+		OnConnectError: func(err error) {
+			connectErrors <- err
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+
+	require.NoError(t, cm.AwaitConnection(ctx))
+	require.Error(t, <-connectErrors)
+	<-ups
+
+	pr, err := cm.Publish(ctx, &paho.Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")})
+	require.NoError(t, err)
+	assert.Equal(t, byte(0), pr.ReasonCode)
+
+	b.Drop()
+	assert.Error(t, <-downs)
+	<-ups
+
+	_, err = cm.Publish(ctx, &paho.Publish{Topic: "test/1", QoS: 1, Payload: []byte("test")})
+	require.NoError(t, err)
+
+	// The Disconnect sent by the server is passed on.
+	require.NoError(t, b.Redirect(packets.DisconnectSessionTakenOver, ""))
+	var derr *paho.DisconnectError
+	require.True(t, errors.As(<-downs, &derr))
+	assert.Equal(t, byte(packets.DisconnectSessionTakenOver), derr.Disconnect.ReasonCode)
+	<-ups
+
+	require.NoError(t, cm.Disconnect(ctx))
+	err = cm.AwaitConnection(ctx)
+	assert.True(t, errors.Is(err, ErrConnectionManagerClosed))
+}
+
+func TestConnectionManagerBrokerURLs(t *testing.T) {
+	// Nothing listens on the first URL, so the second one must be used.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed.Close()
+
+	b := &fakeBroker{}
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		BrokerURLs: []*url.URL{
+			{Scheme: "mqtt", Host: closed.Addr().String()},
+			b.Listen(t),
+		},
+		Backoff: NewConstantBackoff(time.Millisecond),
+	})
+	require.NoError(t, err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	require.NoError(t, cm.AwaitConnection(ctx))
+	require.NoError(t, cm.Disconnect(ctx))
+
+	_, err = NewConnection(context.Background(), ClientConfig{})
+	assert.Error(t, err)
+}
+
+func TestConnectionManagerFailover(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		failover Failover
+		conns    []int // connections made to each broker after a drop.
+	}{
+		{"priority", FailoverPriority, []int{2, 0}},
+		{"round robin", FailoverRoundRobin, []int{1, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			brokers := []*fakeBroker{{}, {}}
+			ups := make(chan struct{}, 2)
+			cm, err := NewConnection(context.Background(), ClientConfig{
+				BrokerURLs: []*url.URL{brokers[0].Listen(t), brokers[1].Listen(t)},
+				Failover:   tc.failover,
+				Backoff:    NewConstantBackoff(time.Millisecond),
+				OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+					ups <- struct{}{}
+				},
+			})
+			require.NoError(t, err)
+			defer cm.Disconnect(context.Background())
+
+			<-ups
+			assert.Equal(t, []int{1, 0}, []int{brokers[0].Conns(), brokers[1].Conns()})
+			brokers[0].Drop()
+			<-ups
+			assert.Equal(t, tc.conns, []int{brokers[0].Conns(), brokers[1].Conns()})
+		})
+	}
+}
+
+func TestConnectionManagerFailoverRefused(t *testing.T) {
+	// The first broker accepts connections but refuses the CONNECT, the
+	// second one must be tried rather than the first one again and again.
+	brokers := []*fakeBroker{{connacks: []byte{0x88, 0x88}}, {}}
+	ups := make(chan struct{}, 2)
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		BrokerURLs: []*url.URL{brokers[0].Listen(t), brokers[1].Listen(t)},
+		Failover:   FailoverPriority,
+		Backoff:    NewConstantBackoff(time.Millisecond),
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+			ups <- struct{}{}
+		},
+	})
+	require.NoError(t, err)
+	defer cm.Disconnect(context.Background())
+
+	<-ups
+	assert.Equal(t, []int{1, 1}, []int{brokers[0].Conns(), brokers[1].Conns()})
+
+	// Once connected, the first broker is preferred again.
+	brokers[1].Drop()
+	<-ups
+	assert.Equal(t, []int{2, 2}, []int{brokers[0].Conns(), brokers[1].Conns()})
+}
+
+func TestConnectionManagerServerReference(t *testing.T) {
+	a, b, c := &fakeBroker{}, &fakeBroker{}, &fakeBroker{}
+	au, bu, cu := a.Listen(t), b.Listen(t), c.Listen(t)
+	a.Refuse([]byte{packets.DisconnectUseAnotherServer}, bu.Host+" "+cu.Host)
+
+	ups := make(chan struct{}, 1)
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		BrokerURLs: []*url.URL{au},
+		Backoff:    NewConstantBackoff(time.Millisecond),
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+			ups <- struct{}{}
+		},
+	})
+	require.NoError(t, err)
+	defer cm.Disconnect(context.Background())
+
+	// Use another server is only followed once.
+	<-ups
+	assert.Equal(t, []int{1, 1, 0}, []int{a.Conns(), b.Conns(), c.Conns()})
+	b.Drop()
+	<-ups
+	assert.Equal(t, []int{2, 1, 0}, []int{a.Conns(), b.Conns(), c.Conns()})
+
+	// Server moved replaces the server in the list.
+	a.Refuse([]byte{packets.DisconnectServerMoved}, cu.String())
+	a.Drop()
+	<-ups
+	assert.Equal(t, []int{3, 1, 1}, []int{a.Conns(), b.Conns(), c.Conns()})
+	c.Drop()
+	<-ups
+	assert.Equal(t, []int{3, 1, 2}, []int{a.Conns(), b.Conns(), c.Conns()})
+
+	// So does a DISCONNECT referencing another server.
+	require.NoError(t, c.Redirect(packets.DisconnectServerMoved, bu.String()))
+	<-ups
+	assert.Equal(t, []int{3, 2, 2}, []int{a.Conns(), b.Conns(), c.Conns()})
+	b.Drop()
+	<-ups
+	assert.Equal(t, []int{3, 3, 2}, []int{a.Conns(), b.Conns(), c.Conns()})
+}
+
+func TestConnectionManagerMaxRedirects(t *testing.T) {
+	a := &fakeBroker{}
+	au := a.Listen(t)
+	a.Refuse([]byte{0x9C, 0x9C, 0x9C, 0}, au.Host)
+
+	var backoffs int
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		BrokerURLs:   []*url.URL{au},
+		MaxRedirects: 2,
+		Backoff: func(int) time.Duration {
+			backoffs++
+			return time.Millisecond
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	require.NoError(t, cm.AwaitConnection(ctx))
+	require.NoError(t, cm.Disconnect(ctx))
+	assert.Equal(t, 4, a.Conns())
+	assert.Equal(t, 1, backoffs)
+}
+
+func TestConnectionManagerMaxRedirectsReset(t *testing.T) {
+	a, b, c := &fakeBroker{}, &fakeBroker{}, &fakeBroker{}
+	au, bu, cu := a.Listen(t), b.Listen(t), c.Listen(t)
+	a.Refuse([]byte{packets.DisconnectUseAnotherServer}, bu.Host)
+
+	ups := make(chan struct{}, 1)
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		BrokerURLs:   []*url.URL{au},
+		MaxRedirects: 1,
+		Backoff:      NewConstantBackoff(time.Millisecond),
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+			ups <- struct{}{}
+		},
+	})
+	require.NoError(t, err)
+	defer cm.Disconnect(context.Background())
+
+	<-ups
+	assert.Equal(t, []int{1, 1, 0}, []int{a.Conns(), b.Conns(), c.Conns()})
+
+	// The connection to b was established, so the redirect that follows
+	// is not a consecutive one.
+	require.NoError(t, b.Redirect(packets.DisconnectUseAnotherServer, cu.Host))
+	<-ups
+	assert.Equal(t, []int{1, 1, 1}, []int{a.Conns(), b.Conns(), c.Conns()})
+}
+
+func TestParseServerReference(t *testing.T) {
+	current := &url.URL{Scheme: "mqtts", Host: "broker.example.com:8884"}
+	for ref, want := range map[string]string{
+		"other.example.com":                "mqtts://other.example.com:8884",
+		"other.example.com:8883":           "mqtts://other.example.com:8883",
+		"[::1] other.example.com":          "mqtts://[::1]:8884",
+		"ws://other.example.com:80/mqtt x": "ws://other.example.com:80/mqtt",
+	} {
+		u, err := parseServerReference(ref, current)
+		require.NoError(t, err)
+		assert.Equal(t, want, u.String())
+	}
+	_, err := parseServerReference(" ", current)
+	assert.Error(t, err)
+}
+
+func TestConnectionManagerResubscribe(t *testing.T) {
+	b := new(fakeBroker)
+	router := rpc.NewTrieRouter()
+
+	ups := make(chan struct{}, 2)
+	downs := make(chan struct{}, 1)
+	resubscribeErrors := make(chan error, 10)
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		Dial:    b.Dial,
+		Backoff: NewConstantBackoff(time.Millisecond),
+		OnConnectionUp: func(*ConnectionManager, *paho.Connack) {
+			ups <- struct{}{}
+		},
+		OnConnectionDown: func(error) {
+			downs <- struct{}{}
+		},
+		OnResubscribeError: func(topic string, err error) {
+			assert.Equal(t, "alerts/#", topic)
+			resubscribeErrors <- err
+		},
+		ClientConfig: paho.ClientConfig{
+			Router: router,
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	require.NoError(t, cm.AwaitConnection(ctx))
+	<-ups
+
+	var received []string
+	var mu sync.Mutex
+	h := func(p *paho.Publish, _ func() error) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, p.Topic)
+	}
+	s := &paho.Subscribe{Subscriptions: make(map[string]paho.SubscribeOptions)}
+	for i := 1; i <= 6; i++ {
+		s.Subscriptions[fmt.Sprintf("sensors/room/%d", i)] = paho.SubscribeOptions{QoS: 1}
+	}
+	_, err = cm.SubscribeHandler(ctx, s, h)
+	require.NoError(t, err)
+	_, err = cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"alerts/#": {QoS: 1}},
+	})
+	require.NoError(t, err)
+	_, err = cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"sensors/room/6"}})
+	require.NoError(t, err)
+	assert.Len(t, cm.Subscriptions(), 6)
+
+	// The server now refuses alerts/# and limits the packet size, so the
+	// subscriptions are replayed in several batches.
+	b.mu.Lock()
+	b.subscribes = nil
+	b.maxPacketSize = 64
+	b.deny = map[string]bool{"alerts/#": true}
+	b.mu.Unlock()
+	b.Drop()
+	<-downs
+	<-ups
+
+	var replayed []string
+	for _, topics := range b.Subscribes() {
+		size := 5
+		for _, t := range topics {
+			size += 2 + len(t) + 1
+		}
+		assert.True(t, size <= 64, "SUBSCRIBE of %d bytes", size)
+		replayed = append(replayed, topics...)
+	}
+	assert.True(t, len(b.Subscribes()) > 1)
+	assert.ElementsMatch(t, []string{
+		"alerts/#", "sensors/room/1", "sensors/room/2", "sensors/room/3", "sensors/room/4", "sensors/room/5",
+	}, replayed)
+
+	require.Len(t, resubscribeErrors, 1)
+	err = <-resubscribeErrors
+	assert.True(t, errors.Is(err, paho.ReasonNotAuthorized))
+	assert.Len(t, cm.Subscriptions(), 5)
+	assert.NotContains(t, cm.Subscriptions(), "alerts/#")
+
+	// The handler stays registered for the filters still subscribed to.
+	router.Route(&packets.Publish{Topic: "sensors/room/1", Properties: &packets.Properties{}}, nil)
+	router.Route(&packets.Publish{Topic: "sensors/room/6", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, []string{"sensors/room/1"}, received)
+
+	require.NoError(t, cm.Disconnect(ctx))
+}
+
+func TestConnectionManagerSubscribeHandlerOwn(t *testing.T) {
+	b := &fakeBroker{deny: map[string]bool{"alerts/#": true}}
+	router := rpc.NewTrieRouter()
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		Dial:    b.Dial,
+		Backoff: NewConstantBackoff(time.Millisecond),
+		ClientConfig: paho.ClientConfig{
+			Router: router,
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	require.NoError(t, cm.AwaitConnection(ctx))
+
+	var received []string
+	handler := func(name string) func(*paho.Publish, func() error) {
+		return func(p *paho.Publish, _ func() error) {
+			received = append(received, name+" "+p.Topic)
+		}
+	}
+	// Handlers registered by others are left alone by SubscribeHandler.
+	router.RegisterHandler("alerts/#", handler("other"))
+	router.RegisterHandler("sensors/#", handler("other"))
+
+	_, err = cm.SubscribeHandler(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"alerts/#": {QoS: 1}, "sensors/#": {QoS: 1}, "sensors/+": {QoS: 1}},
+	}, handler("own"))
+	assert.True(t, errors.Is(err, paho.ReasonNotAuthorized))
+	router.Route(&packets.Publish{Topic: "alerts/fire", Properties: &packets.Properties{}}, nil)
+	// The handler is invoked once however many of its filters match.
+	router.Route(&packets.Publish{Topic: "sensors/1", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, []string{"other alerts/fire", "other sensors/1", "own sensors/1"}, received)
+
+	// Each filter is unsubscribed from on its own.
+	received = nil
+	_, err = cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"sensors/#"}})
+	require.NoError(t, err)
+	router.Route(&packets.Publish{Topic: "sensors/1", Properties: &packets.Properties{}}, nil)
+	router.Route(&packets.Publish{Topic: "sensors/1/a", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, []string{"other sensors/1", "own sensors/1", "other sensors/1/a"}, received)
+
+	received = nil
+	_, err = cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{"sensors/+"}})
+	require.NoError(t, err)
+	router.Route(&packets.Publish{Topic: "sensors/1", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, []string{"other sensors/1"}, received)
+
+	_, err = cm.SubscribeHandler(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"sensors/#": {QoS: 1}},
+	}, handler("own"))
+	require.NoError(t, err)
+	_, err = cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"sensors/#": {QoS: 0}},
+	})
+	require.NoError(t, err)
+	// Subscribing again replaces the handler along with the subscription.
+	received = nil
+	router.Route(&packets.Publish{Topic: "sensors/1", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, []string{"other sensors/1"}, received)
+
+	require.NoError(t, cm.Disconnect(ctx))
+}
+
+func TestAwaitConnectionContext(t *testing.T) {
+	cm, err := NewConnection(context.Background(), ClientConfig{
+		Dial: func(context.Context) (net.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+		Backoff: NewConstantBackoff(time.Millisecond),
+	})
+	require.NoError(t, err)
+	defer cm.Disconnect(context.Background())
+
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	assert.Equal(t, context.DeadlineExceeded, cm.AwaitConnection(ctx))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := NewExponentialBackoff(100*time.Millisecond, time.Second)
+
+	assert.InDelta(t, float64(100*time.Millisecond), float64(b(0)), float64(25*time.Millisecond))
+	assert.InDelta(t, float64(400*time.Millisecond), float64(b(2)), float64(100*time.Millisecond))
+	assert.InDelta(t, float64(time.Second), float64(b(10)), float64(250*time.Millisecond))
+	assert.True(t, b(100) <= time.Second)
+}
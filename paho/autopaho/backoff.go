@@ -0,0 +1,41 @@
+package autopaho
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns the delay to wait before the given reconnection attempt.
+// Attempts are counted from zero and the count is reset once a connection
+// has been established.
+type Backoff func(attempt int) time.Duration
+
+// DefaultBackoff is the Backoff used when ClientConfig.Backoff is nil.
+var DefaultBackoff = NewExponentialBackoff(time.Second, 2*time.Minute)
+
+// NewConstantBackoff returns a Backoff that always waits for d.
+func NewConstantBackoff(d time.Duration) Backoff {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// NewExponentialBackoff returns a Backoff that starts with min and doubles
+// the delay on every attempt until max is reached. Up to a quarter of the
+// delay is randomised so that many clients dropped at the same time do not
+// reconnect in lockstep.
+func NewExponentialBackoff(min, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := min
+		for i := 0; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		if j := int64(d / 4); j > 0 {
+			d -= time.Duration(rand.Int63n(j))
+		}
+		return d
+	}
+}
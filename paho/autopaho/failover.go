@@ -0,0 +1,123 @@
+package autopaho
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// Failover determines the order in which BrokerURLs are tried.
+type Failover int
+
+const (
+	// FailoverPriority tries BrokerURLs in order on every connection
+	// attempt, so that the first reachable server is always preferred.
+	// After a failed attempt, such as a refused CONNACK, the next one
+	// starts with the URL following the server which failed.
+	FailoverPriority Failover = iota
+	// FailoverRoundRobin starts every connection attempt with the URL
+	// following the one last connected to, spreading reconnections over
+	// all of the servers.
+	FailoverRoundRobin
+)
+
+// DefaultMaxRedirects is the number of consecutive server references,
+// without a connection being established in between, followed when
+// ClientConfig.MaxRedirects is not set.
+const DefaultMaxRedirects = 3
+
+// dial connects to the server the next connection attempt should be made
+// to: the server reference received last if there is one, otherwise the
+// first reachable server of the list in the order set by Failover.
+func (c *ConnectionManager) dial(ctx context.Context) (net.Conn, error) {
+	if u := c.redirect; u != nil {
+		c.redirect = nil
+		c.current = u
+		return c.cfg.Dialer.Dial(ctx, u)
+	}
+
+	start := 0
+	if c.cfg.Failover == FailoverRoundRobin || c.failed {
+		start = c.next
+	}
+	var err error
+	for i := range c.urls {
+		idx := (start + i) % len(c.urls)
+		var conn net.Conn
+		if conn, err = c.cfg.Dialer.Dial(ctx, c.urls[idx]); err == nil {
+			c.current = c.urls[idx]
+			c.next = idx + 1
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// followReference arranges for the next connection attempt to be made to
+// the server referenced by a CONNACK or DISCONNECT with one of the Use
+// another server or Server moved reason codes. When the server has moved
+// the reference also replaces the URL of the current server in the list.
+// It reports whether the reference is to be followed.
+func (c *ConnectionManager) followReference(code byte, ref string) bool {
+	if code != packets.DisconnectUseAnotherServer && code != packets.DisconnectServerMoved {
+		return false
+	}
+	if ref == "" || c.current == nil || c.cfg.MaxRedirects < 0 {
+		return false
+	}
+	if c.redirects >= c.cfg.MaxRedirects {
+		c.log(paho.LevelWarn, fmt.Sprintf("not following server reference %q, too many redirects", ref), nil)
+		return false
+	}
+	u, err := parseServerReference(ref, c.current)
+	if err != nil {
+		c.log(paho.LevelWarn, "invalid server reference", err)
+		return false
+	}
+
+	c.redirects++
+	if code == packets.DisconnectServerMoved {
+		for i := range c.urls {
+			if c.urls[i] == c.current {
+				c.urls[i] = u
+			}
+		}
+	}
+	c.redirect = u
+	c.log(paho.LevelDebug, fmt.Sprintf("following server reference to %s", u), nil)
+
+	return true
+}
+
+// parseServerReference returns the URL of the first server in a Server
+// Reference property, which holds a space separated list of references.
+// A reference may be a full URL, otherwise it is a host with an optional
+// port and the scheme, and port if missing, of the current URL are kept.
+func parseServerReference(ref string, current *url.URL) (*url.URL, error) {
+	fields := strings.Fields(ref)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty server reference")
+	}
+	ref = fields[0]
+	if strings.Contains(ref, "://") {
+		return url.Parse(ref)
+	}
+
+	u := *current
+	u.Host = ref
+	if _, _, err := net.SplitHostPort(ref); err != nil && current.Port() != "" {
+		u.Host = net.JoinHostPort(strings.Trim(ref, "[]"), current.Port())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid server reference %q", ref)
+	}
+	return &u, nil
+}
@@ -0,0 +1,236 @@
+package autopaho
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// HandlerRegistry is implemented by the Routers SubscribeHandler registers
+// handlers with, such as rpc.TrieRouter and rpc.SubIDRouter.
+type HandlerRegistry interface {
+	paho.Router
+	// Register registers h for filters, returning the id to Unregister it
+	// with, which is never zero. h is invoked once per Publish however
+	// many of the filters match its topic.
+	Register(h func(*paho.Publish, func() error), filters ...string) uint64
+	// Unregister removes the handler registered with id from filters, or
+	// from all its filters if none are given, leaving the other handlers
+	// of those filters in place.
+	Unregister(id uint64, filters ...string)
+}
+
+// subscription is a topic filter recorded by the ConnectionManager, so
+// that it can be subscribed to again on connections without a session.
+type subscription struct {
+	options paho.SubscribeOptions
+	// properties are those of the Subscribe the filter was part of, the
+	// filters sharing them are subscribed to again together.
+	properties *paho.SubscribeProperties
+	// handler is the id the handler for the filter is registered with the
+	// Router under, zero if none. It is shared by the filters subscribed
+	// to together.
+	handler uint64
+}
+
+// Subscribe waits for a live connection and then sends s on it. The topic
+// filters successfully subscribed to are recorded and subscribed to again
+// whenever a new connection is established without a session.
+func (c *ConnectionManager) Subscribe(ctx context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	return c.subscribe(ctx, s, 0)
+}
+
+// SubscribeHandler is like Subscribe, also registering h with the Router,
+// which must be a HandlerRegistry, for the topic filters of s until they
+// are unsubscribed from or subscribed to again. Other handlers registered
+// for the same filters are left in place.
+func (c *ConnectionManager) SubscribeHandler(ctx context.Context, s *paho.Subscribe, h func(*paho.Publish, func() error)) (*paho.Suback, error) {
+	r, ok := c.cfg.Router.(HandlerRegistry)
+	if !ok {
+		return nil, fmt.Errorf("autopaho: handlers require a HandlerRegistry, not %T", c.cfg.Router)
+	}
+	// The handler is registered first as retained messages may arrive as
+	// soon as the subscription is made, for all the filters at once so
+	// that it is invoked once per Publish matching several of them.
+	id := r.Register(h, s.Topics()...)
+	sa, err := c.subscribe(ctx, s, id)
+	for i, t := range s.Topics() {
+		if sa == nil || (i < len(sa.Reasons) && sa.Reasons[i] >= 0x80) {
+			r.Unregister(id, t)
+		}
+	}
+	return sa, err
+}
+
+// subscribe sends s and records its successful topic filters, id being
+// that of the handler registered for them if any.
+func (c *ConnectionManager) subscribe(ctx context.Context, s *paho.Subscribe, id uint64) (*paho.Suback, error) {
+	cli, err := c.awaitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sa, err := cli.Subscribe(ctx, s)
+	if sa == nil {
+		return sa, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range s.Topics() {
+		if i < len(sa.Reasons) && sa.Reasons[i] >= 0x80 {
+			continue
+		}
+		if old, ok := c.subs[t]; ok {
+			c.unregister(t, old)
+		}
+		c.subs[t] = &subscription{
+			options:    s.Subscriptions[t],
+			properties: s.Properties,
+			handler:    id,
+		}
+	}
+
+	return sa, err
+}
+
+// Unsubscribe waits for a live connection and then sends u on it. The
+// topic filters unsubscribed from are forgotten, and their handlers
+// unregistered from the Router.
+func (c *ConnectionManager) Unsubscribe(ctx context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	cli, err := c.awaitClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ua, err := cli.Unsubscribe(ctx, u)
+	if ua == nil {
+		return ua, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, t := range u.Topics {
+		// No subscription existed is as good as a successful unsubscribe.
+		if i < len(ua.Reasons) && ua.Reasons[i] >= 0x80 {
+			continue
+		}
+		if sub, ok := c.subs[t]; ok {
+			delete(c.subs, t)
+			c.unregister(t, sub)
+		}
+	}
+
+	return ua, err
+}
+
+// unregister removes the handler of sub, if any, from topic in the
+// Router.
+func (c *ConnectionManager) unregister(topic string, sub *subscription) {
+	if sub.handler != 0 {
+		c.cfg.Router.(HandlerRegistry).Unregister(sub.handler, topic)
+	}
+}
+
+// Subscriptions returns the topic filters recorded by the
+// ConnectionManager, along with their options.
+func (c *ConnectionManager) Subscriptions() map[string]paho.SubscribeOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subs := make(map[string]paho.SubscribeOptions, len(c.subs))
+	for t, sub := range c.subs {
+		subs[t] = sub.options
+	}
+	return subs
+}
+
+// resubscribe subscribes cli to the recorded topic filters again, in as
+// few Subscribe packets as the Maximum Packet Size of the server allows.
+// The filters refused by the server are forgotten and reported to
+// OnResubscribeError along with those which could not be sent.
+func (c *ConnectionManager) resubscribe(ctx context.Context, cli *paho.Client, maxPacketSize uint32) {
+	c.mu.Lock()
+	groups := make(map[*paho.SubscribeProperties][]string)
+	for t, sub := range c.subs {
+		groups[sub.properties] = append(groups[sub.properties], t)
+	}
+	var batches []*paho.Subscribe
+	for props, topics := range groups {
+		sort.Strings(topics)
+		batches = append(batches, c.batch(props, topics, maxPacketSize)...)
+	}
+	c.mu.Unlock()
+
+	for _, s := range batches {
+		c.log(paho.LevelDebug, fmt.Sprintf("resubscribing to %d topic filters", len(s.Subscriptions)), nil)
+		sa, err := cli.Subscribe(ctx, s)
+		if sa == nil {
+			for _, t := range s.Topics() {
+				c.resubscribeError(t, err)
+			}
+			if errors.Is(err, paho.ErrClosed) || ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		for i, t := range s.Topics() {
+			if i >= len(sa.Reasons) || sa.Reasons[i] < 0x80 {
+				continue
+			}
+			c.mu.Lock()
+			if sub, ok := c.subs[t]; ok && sub.properties == s.Properties {
+				delete(c.subs, t)
+				c.unregister(t, sub)
+			}
+			c.mu.Unlock()
+			c.resubscribeError(t, &paho.ReasonError{
+				PacketType:   packets.SUBACK,
+				Code:         paho.ReasonCode(sa.Reasons[i]),
+				ReasonString: sa.Properties.ReasonString,
+				User:         sa.Properties.User,
+			})
+		}
+	}
+}
+
+// batch splits topics into Subscribes with the given properties which do
+// not exceed maxPacketSize, unless a single topic filter does. c.mu must
+// be held.
+func (c *ConnectionManager) batch(props *paho.SubscribeProperties, topics []string, maxPacketSize uint32) []*paho.Subscribe {
+	newSubscribe := func() *paho.Subscribe {
+		return &paho.Subscribe{
+			Properties:    props,
+			Subscriptions: make(map[string]paho.SubscribeOptions),
+		}
+	}
+	// The size of the Remaining Length grows by up to 3 bytes along with
+	// the packet, it is accounted for up front.
+	empty := packets.PacketSize(newSubscribe().Packet()) + 3
+
+	var batches []*paho.Subscribe
+	s, size := newSubscribe(), empty
+	for _, t := range topics {
+		// A topic filter is a length prefixed string followed by the
+		// subscription options byte.
+		n := 2 + len(t) + 1
+		if maxPacketSize > 0 && len(s.Subscriptions) > 0 && size+n > int(maxPacketSize) {
+			batches = append(batches, s)
+			s, size = newSubscribe(), empty
+		}
+		s.Subscriptions[t] = c.subs[t].options
+		size += n
+	}
+	if len(s.Subscriptions) > 0 {
+		batches = append(batches, s)
+	}
+	return batches
+}
+
+func (c *ConnectionManager) resubscribeError(topic string, err error) {
+	c.log(paho.LevelWarn, fmt.Sprintf("resubscribing to %s failed", topic), err)
+	if c.cfg.OnResubscribeError != nil {
+		c.cfg.OnResubscribeError(topic, err)
+	}
+}
@@ -1,6 +1,7 @@
 package paho
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/semaphore"
@@ -19,12 +21,22 @@ var (
 	DefaultKeepAlive       = 60 * time.Second
 	DefaultShutdownTimeout = 10 * time.Second
 	DefaultPacketTimeout   = 10 * time.Second
+	// DefaultWorkers is the number of goroutines routing Publishes, or
+	// their maximum in the DispatchConcurrent mode, when Workers is not
+	// set.
+	DefaultWorkers = 8
+	// DefaultQueueSize is the number of QoS0 Publishes which may wait to
+	// be routed when QueueSize is not set.
+	DefaultQueueSize = 1024
 )
 
 // Router is an interface that capable of handling publish packets.
 //
 // NOTE: its a Router responsibility to deal with concurrent packets processing
-// (if needed).
+// (if needed), Route is called concurrently unless ClientConfig.Dispatch
+// says otherwise, by at most ClientConfig.Workers (DefaultWorkers if not
+// set) goroutines at once. Inbound topic aliases are resolved by the Client,
+// so the Publishes passed to Route always carry their full topic.
 type Router interface {
 	Route(pb *packets.Publish, ack func() error)
 }
@@ -50,16 +62,42 @@ type (
 	// are required to be set, defaults are provided for Persistence, MIDs,
 	// PacketTimeout and Router.
 	ClientConfig struct {
-		Conn            net.Conn
-		MIDs            MIDService
-		AuthHandler     Auther
-		Router          Router
-		Persistence     Persistence
+		Conn        net.Conn
+		MIDs        MIDService
+		AuthHandler Auther
+		Router      Router
+		Persistence Persistence
+		// InboundPersistence, if set, stores the Pubrec sent for every
+		// inbound QoS2 Publish until the matching Pubrel arrives, so that
+		// redelivered messages are recognised across restarts.
+		InboundPersistence Persistence
+		// AutoTopicAlias makes the client assign topic aliases to outbound
+		// Publishes itself, up to the TopicAliasMaximum of the server, so
+		// that repeated topics are only sent once per connection.
+		// Publishes must not set a TopicAlias of their own when enabled.
+		AutoTopicAlias bool
+		// Dispatch determines how received Publishes are passed to the
+		// Router, Workers sets the number of goroutines routing them,
+		// except in the DispatchSequential mode, and QueueSize the number
+		// of QoS0 Publishes which may wait for one of them.
+		Dispatch  DispatchMode
+		Workers   int
+		QueueSize int
+		// AckMode determines when received Publishes are acknowledged,
+		// AckTimeout bounds the time an acknowledgement may be held back
+		// in the AckOrdered and AckAuto modes, see DefaultAckTimeout.
+		AckMode         AckMode
+		AckTimeout      time.Duration
 		PacketTimeout   time.Duration
 		ShutdownTimeout time.Duration
 		Trace           Trace
 		Logger          func(context.Context, LogEntry)
-		OnClose         func()
+		// OnClose is called once the client has been closed after a
+		// successful Connect, Err returns the reason it was closed.
+		OnClose func()
+		// OnServerDisconnect is called with the Disconnect sent by the
+		// server, if any, before the client is closed.
+		OnServerDisconnect func(*Disconnect)
 	}
 	// Client is the struct representing an MQTT client
 	Client struct {
@@ -70,9 +108,11 @@ type (
 		connectOnce sync.Once
 		ca          *Connack // connection ack.
 		cerr        error    // connection error.
+		clientID    string   // see ClientID.
 
 		mu             sync.Mutex
 		closed         bool
+		err            error // terminal error, see Err.
 		caCtx          *caContext
 		raCtx          *CPContext
 		exit           chan struct{}
@@ -86,6 +126,24 @@ type (
 		clientProps    CommsProperties
 		serverInflight *semaphore.Weighted
 		clientInflight *semaphore.Weighted
+		topicAliases   *topicAliases
+		// acks orders the acknowledgements of received Publishes, it is
+		// nil in the AckManual mode.
+		acks *ackSequencer
+		// maxPacketSize is the MaximumPacketSize of the server, it is
+		// accessed atomically as write may be called while it is set.
+		maxPacketSize uint32
+		// inboundAliases maps the topic aliases set by the server to
+		// their topics, it is only used by the reader goroutine.
+		inboundAliases map[uint16]string
+
+		// awaitingRel holds the ids of inbound QoS2 Publishes which have
+		// been acknowledged with a Pubrec but not yet released.
+		// inboundInflight counts the inbound QoS1 and QoS2 Publishes for
+		// which no Puback or Pubcomp has been sent yet.
+		relMu           sync.Mutex
+		awaitingRel     map[uint16]struct{}
+		inboundInflight int
 	}
 
 	// CommsProperties is a struct of the communication properties that may
@@ -133,14 +191,16 @@ func NewClient(conf ClientConfig) *Client {
 			MaximumPacketSize: 0,
 			TopicAliasMaximum: 0,
 		},
-		exit:         make(chan struct{}),
-		done:         make(chan struct{}),
-		writeq:       make(chan io.WriterTo),
-		writerDone:   make(chan struct{}),
-		readerDone:   make(chan struct{}),
-		pingerDone:   make(chan struct{}),
-		pong:         make(chan struct{}, 1),
-		ClientConfig: conf,
+		exit:           make(chan struct{}),
+		done:           make(chan struct{}),
+		writeq:         make(chan io.WriterTo),
+		writerDone:     make(chan struct{}),
+		readerDone:     make(chan struct{}),
+		pingerDone:     make(chan struct{}),
+		pong:           make(chan struct{}, 1),
+		awaitingRel:    make(map[uint16]struct{}),
+		inboundAliases: make(map[uint16]string),
+		ClientConfig:   conf,
 	}
 
 	if c.Persistence == nil {
@@ -173,10 +233,16 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 	c.connectOnce.Do(func() {
 		defer func() {
 			if c.cerr != nil {
+				// The pinger is only started once the connection is
+				// established, so release close() from waiting for it.
+				close(c.pingerDone)
+				c.setErr(c.cerr)
 				c.close()
 			}
 		}()
 
+		c.clientID = cp.ClientID
+
 		keepalive := cp.KeepAlive
 		if keepalive == 0 {
 			keepalive = uint16(DefaultKeepAlive / time.Second)
@@ -196,6 +262,32 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 			}
 		}
 
+		if c.InboundPersistence != nil {
+			for _, p := range c.InboundPersistence.All() {
+				if p.Content != nil {
+					c.awaitingRel[p.PacketID()] = struct{}{}
+				}
+			}
+			c.inboundInflight = len(c.awaitingRel)
+		}
+
+		if c.AckMode != AckManual {
+			c.acks = &ackSequencer{
+				timeout: c.AckTimeout,
+				onTimeout: func(id uint16) {
+					c.log(LevelWarn, fmt.Sprintf("PUBLISH %d not acknowledged in time, acknowledging it", id))
+				},
+				onError: func(id uint16, err error) {
+					c.log(LevelWarn, fmt.Sprintf("acknowledging PUBLISH %d failed", id), func(e *LogEntry) {
+						e.Error = err
+					})
+				},
+			}
+			if c.acks.timeout == 0 {
+				c.acks.timeout = DefaultAckTimeout
+			}
+		}
+
 		go c.writer()
 		go c.reader()
 
@@ -234,11 +326,12 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 		c.ca = ca
 
 		if ca.ReasonCode >= 0x80 {
-			var reason string
+			rerr := &ReasonError{PacketType: packets.CONNACK, Code: ReasonCode(ca.ReasonCode)}
 			if ca.Properties != nil {
-				reason = ca.Properties.ReasonString
+				rerr.ReasonString = ca.Properties.ReasonString
+				rerr.User = ca.Properties.User
 			}
-			c.cerr = fmt.Errorf("failed to connect to server: %s", reason)
+			c.cerr = rerr
 			return
 		}
 
@@ -246,9 +339,9 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 			if ca.Properties.ServerKeepAlive != nil {
 				keepalive = *ca.Properties.ServerKeepAlive
 			}
-			//if ca.Properties.AssignedClientID != "" {
-			//	c.ClientID = ca.Properties.AssignedClientID
-			//}
+			if ca.Properties.AssignedClientID != "" {
+				c.clientID = ca.Properties.AssignedClientID
+			}
 			if ca.Properties.ReceiveMaximum != nil {
 				c.serverProps.ReceiveMaximum = *ca.Properties.ReceiveMaximum
 			}
@@ -269,12 +362,65 @@ func (c *Client) Connect(ctx context.Context, cp *Connect) (*Connack, error) {
 
 		c.serverInflight = semaphore.NewWeighted(int64(c.serverProps.ReceiveMaximum))
 		c.clientInflight = semaphore.NewWeighted(int64(c.clientProps.ReceiveMaximum))
+		atomic.StoreUint32(&c.maxPacketSize, c.serverProps.MaximumPacketSize)
+		if c.AutoTopicAlias {
+			c.topicAliases = newTopicAliases(c.serverProps.TopicAliasMaximum)
+		}
+
+		if ca.SessionPresent {
+			if c.cerr = c.resendSession(ctx); c.cerr != nil {
+				return
+			}
+		} else {
+			// The server has no session for us, so any state kept from a
+			// previous connection is now meaningless.
+			c.Persistence.Reset()
+		}
 
 		go c.pinger(time.Duration(keepalive) * time.Second)
 	})
 	return c.ca, c.cerr
 }
 
+// resendSession retransmits the unacknowledged PUBLISH and PUBREL packets
+// stored in Persistence when the server resumes an existing session.
+// Publishes are resent with the DUP flag set as required by the spec.
+func (c *Client) resendSession(ctx context.Context) error {
+	session := c.Persistence.All()
+	if len(session) == 0 {
+		return nil
+	}
+	claimer, ok := c.MIDs.(MIDClaimer)
+	if !ok {
+		return fmt.Errorf("cannot resend the %d packets of the session, %T does not implement MIDClaimer", len(session), c.MIDs)
+	}
+	for _, cp := range session {
+		if cp.Content == nil {
+			continue
+		}
+		id := cp.PacketID()
+		cpCtx := &CPContext{context.Background(), make(chan packets.ControlPacket, 1)}
+		if err := claimer.Claim(id, cpCtx); err != nil {
+			return err
+		}
+		if err := c.serverInflight.Acquire(ctx, 1); err != nil {
+			return err
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Publish:
+			p.Duplicate = true
+			c.logCtx(ctx, LevelDebug, fmt.Sprintf("resending PUBLISH %d", id))
+		case *packets.Pubrel:
+			c.logCtx(ctx, LevelDebug, fmt.Sprintf("resending PUBREL %d", id))
+		}
+		if err := c.write(ctx, cp.Content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Client) waitConnected() {
 	var dummy bool
 	c.connectOnce.Do(func() {
@@ -297,6 +443,40 @@ func (c *Client) Done() <-chan struct{} {
 	return c.done
 }
 
+// ClientID returns the client identifier of the connection, which is the
+// one assigned by the server when the Connect did not set any.
+func (c *Client) ClientID() string {
+	c.waitConnected()
+	return c.clientID
+}
+
+// Connack returns the Connack received in response to the Connect, or nil
+// if none was.
+func (c *Client) Connack() *Connack {
+	c.waitConnected()
+	return c.ca
+}
+
+// Err returns the error which caused the client to close, ErrClosed if it
+// was closed by Close or Shutdown, or nil while it is still running. When
+// the server closed the connection with a Disconnect the error is a
+// *DisconnectError.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// setErr records err as the error returned by Err, unless another error
+// was recorded first.
+func (c *Client) setErr(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
 func (c *Client) close() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -304,6 +484,9 @@ func (c *Client) close() {
 		return
 	}
 	c.closed = true
+	if c.err == nil {
+		c.err = ErrClosed
+	}
 	go func() {
 		c.log(LevelDebug, "closing")
 
@@ -315,6 +498,9 @@ func (c *Client) close() {
 
 		_ = c.Conn.Close()
 		<-c.readerDone
+		if c.acks != nil {
+			c.acks.close()
+		}
 		close(c.done)
 
 		if c.cerr == nil && c.OnClose != nil {
@@ -327,6 +513,8 @@ func (c *Client) close() {
 
 func (c *Client) Shutdown(ctx context.Context) {
 	c.waitConnected()
+	// The server closing the connection in response is expected.
+	c.setErr(ErrClosed)
 	err := c.write(ctx, packets.NewControlPacket(packets.DISCONNECT))
 	if err == nil {
 		select {
@@ -353,6 +541,9 @@ func (c *Client) write(ctx context.Context, w io.WriterTo) (err error) {
 	defer func() {
 		t.done(ctx, err)
 	}()
+	if err := c.checkPacketSize(w); err != nil {
+		return err
+	}
 	select {
 	case <-c.exit:
 		return ErrClosed
@@ -363,11 +554,39 @@ func (c *Client) write(ctx context.Context, w io.WriterTo) (err error) {
 	}
 }
 
+// checkPacketSize returns a *packets.PacketTooLargeError if w is bigger than
+// the MaximumPacketSize of the server, such a packet must not be sent.
+func (c *Client) checkPacketSize(w io.WriterTo) error {
+	limit := atomic.LoadUint32(&c.maxPacketSize)
+	if limit == 0 {
+		return nil
+	}
+
+	var p packets.Packet
+	switch v := w.(type) {
+	case *packets.ControlPacket:
+		p = v.Content
+	case packets.Packet:
+		p = v
+	default:
+		return nil
+	}
+	if size := packets.PacketSize(p); size > int(limit) {
+		return &packets.PacketTooLargeError{Type: matchPacketType(w), Size: size, Limit: limit}
+	}
+
+	return nil
+}
+
 func (c *Client) writer() {
 	defer func() {
 		c.log(LevelDebug, "writer stopped")
 		close(c.writerDone)
 	}()
+	// Packets are encoded into buf and written at once, rather than one
+	// segment at a time, so that message based connections such as
+	// WebSockets send each packet as a single message.
+	var buf bytes.Buffer
 	for {
 		var w io.WriterTo
 		select {
@@ -375,7 +594,14 @@ func (c *Client) writer() {
 			return
 		case w = <-c.writeq:
 		}
-		_, err := w.WriteTo(c.Conn)
+		if pb, ok := w.(*packets.Publish); ok && c.topicAliases != nil {
+			w = c.topicAliases.apply(pb)
+		}
+		buf.Reset()
+		_, err := w.WriteTo(&buf)
+		if err == nil {
+			_, err = c.Conn.Write(buf.Bytes())
+		}
 		if err != nil {
 			c.fail(context.Background(), fmt.Errorf("write packet error: %w", err))
 			return
@@ -390,18 +616,25 @@ func (c *Client) writer() {
 // a packet from the network connection
 func (c *Client) reader() {
 	ctx := context.Background()
+	// dispatch is set up along with the first Publish received.
+	var dispatch func(*packets.Publish, func() error)
 	defer func() {
 		c.logCtx(ctx, LevelDebug, "reader stopped")
 		close(c.readerDone)
 	}()
 	for {
 		t := c.traceRecv(ctx)
-		recv, err := packets.ReadPacket(c.Conn)
+		recv, err := packets.ReadPacketLimit(c.Conn, c.clientProps.MaximumPacketSize)
 		t.done(ctx, recv, err)
 		if err == io.EOF {
+			c.setErr(fmt.Errorf("connection closed by server: %w", err))
 			c.close()
 			return
 		}
+		if _, ok := err.(*packets.PacketTooLargeError); ok {
+			c.failWithDisconnect(ctx, packets.DisconnectPacketTooLarge, err)
+			return
+		}
 		if err != nil {
 			c.fail(ctx, err)
 			return
@@ -415,6 +648,11 @@ func (c *Client) reader() {
 			}
 		case packets.CONNACK:
 			cnnap := recv.Content.(*packets.Connack)
+			if !cnnap.SessionPresent {
+				// Forget inbound QoS2 state before the server gets a chance
+				// to send any Publish for the new session.
+				c.resetAwaitingRel()
+			}
 			// NOTE: No need to acquire a lock for caCtx because it never changes
 			if c.caCtx != nil {
 				c.caCtx.Return <- cnnap
@@ -443,32 +681,73 @@ func (c *Client) reader() {
 			}
 		case packets.PUBLISH:
 			pb := recv.Content.(*packets.Publish)
-			ack := func() error {
-				switch pb.QoS {
-				case 1:
-					pa := packets.Puback{
-						Properties: &packets.Properties{},
-						PacketID:   pb.PacketID,
-					}
-					return c.write(ctx, &pa)
-				case 2:
-					pr := packets.Pubrec{
-						Properties: &packets.Properties{},
-						PacketID:   pb.PacketID,
-					}
-					return c.write(ctx, &pr)
+			pb.ReceivedAt = time.Now()
+			if code, err := c.resolveTopicAlias(pb); err != nil {
+				c.failWithDisconnect(ctx, code, err)
+				return
+			}
+			if pb.QoS == 2 && c.isAwaitingRel(pb.PacketID) {
+				// This message has already been received and passed on, it
+				// must not be delivered again; just repeat the Pubrec.
+				c.logCtx(ctx, LevelDebug, fmt.Sprintf("dropping duplicate QoS2 PUBLISH %d", pb.PacketID))
+				pr := packets.Pubrec{
+					Properties: &packets.Properties{},
+					PacketID:   pb.PacketID,
 				}
-
-				return nil
+				if err := c.write(ctx, &pr); err != nil {
+					c.fail(ctx, err)
+					return
+				}
+				continue
+			}
+			if pb.QoS > 0 && !c.addInboundInflight() {
+				c.failWithDisconnect(ctx, packets.DisconnectReceiveMaximumExceeded, fmt.Errorf(
+					"server exceeded receive maximum of %d", c.clientProps.ReceiveMaximum,
+				))
+				return
+			}
+			var ackOnce sync.Once
+			send := func() (err error) {
+				ackOnce.Do(func() {
+					switch pb.QoS {
+					case 1:
+						pa := packets.Puback{
+							Properties: &packets.Properties{},
+							PacketID:   pb.PacketID,
+						}
+						c.releaseInboundInflight()
+						err = c.write(ctx, &pa)
+					case 2:
+						pr := packets.Pubrec{
+							Properties: &packets.Properties{},
+							PacketID:   pb.PacketID,
+						}
+						c.addAwaitingRel(&pr)
+						err = c.write(ctx, &pr)
+					}
+				})
+				return err
+			}
+			ack := send
+			if pb.QoS > 0 && c.acks != nil {
+				ack = c.acks.add(pb.PacketID, send)
 			}
 
 			if c.Router != nil {
-				go c.Router.Route(pb, ack)
+				if dispatch == nil {
+					dispatch = c.dispatcher()
+				}
+				dispatch(pb, ack)
 			} else {
 				_ = ack()
 			}
 		case packets.PUBACK, packets.PUBCOMP, packets.SUBACK, packets.UNSUBACK:
 			if cpCtx := c.MIDs.Get(recv.PacketID()); cpCtx != nil {
+				if recv.Type == packets.PUBACK || recv.Type == packets.PUBCOMP {
+					// The QoS 1/2 flow is complete.
+					c.Persistence.Delete(recv.PacketID())
+					c.serverInflight.Release(1)
+				}
 				c.MIDs.Free(recv.PacketID())
 				cpCtx.Return <- *recv
 			} else {
@@ -496,27 +775,36 @@ func (c *Client) reader() {
 				pr := recv.Content.(*packets.Pubrec)
 				if pr.ReasonCode >= 0x80 {
 					//Received a failure code, shortcut and return
+					c.Persistence.Delete(recv.PacketID())
+					c.serverInflight.Release(1)
 					c.MIDs.Free(recv.PacketID())
 					cpCtx.Return <- *recv
 				} else {
 					pl := packets.Pubrel{
 						PacketID: pr.PacketID,
 					}
+					// From now on the PUBREL is what must be resent if the
+					// connection is lost.
+					c.Persistence.Put(pl.PacketID, packets.ControlPacket{
+						FixedHeader: packets.FixedHeader{Type: packets.PUBREL, Flags: 2},
+						Content:     &pl,
+					})
 					_ = c.write(ctx, &pl)
 				}
 			}
 		case packets.PUBREL:
-			//Auto respond to pubrels unless failure code
+			// The QoS2 flow for this id is complete, whatever the reason
+			// code the Pubrel carries.
 			pr := recv.Content.(*packets.Pubrel)
-			if pr.ReasonCode < 0x80 {
-				//Received a failure code, continue
-				continue
+			pc := packets.Pubcomp{
+				PacketID: pr.PacketID,
+			}
+			if c.removeAwaitingRel(pr.PacketID) {
+				c.releaseInboundInflight()
 			} else {
-				pc := packets.Pubcomp{
-					PacketID: pr.PacketID,
-				}
-				_ = c.write(ctx, &pc)
+				pc.ReasonCode = packets.PubcompPacketIdentifierNotFound
 			}
+			_ = c.write(ctx, &pc)
 		case packets.DISCONNECT:
 			c.mu.Lock()
 			raCtx := c.raCtx
@@ -524,12 +812,106 @@ func (c *Client) reader() {
 			if raCtx != nil {
 				raCtx.Return <- *recv
 			}
-			c.fail(ctx, fmt.Errorf("received server initiated disconnect"))
+			d := DisconnectFromPacketDisconnect(recv.Content.(*packets.Disconnect))
+			if c.OnServerDisconnect != nil {
+				c.OnServerDisconnect(d)
+			}
+			c.fail(ctx, &DisconnectError{Disconnect: d})
 			return
 		}
 	}
 }
 
+// resolveTopicAlias records the topic alias set on an inbound Publish, or
+// fills in its topic from a previously recorded alias, so that the Router
+// always sees the full topic. If the Publish is invalid the reason code to
+// disconnect with is returned along with the error.
+func (c *Client) resolveTopicAlias(pb *packets.Publish) (byte, error) {
+	if pb.Properties == nil || pb.Properties.TopicAlias == nil {
+		if pb.Topic == "" {
+			return packets.DisconnectProtocolError, fmt.Errorf("received PUBLISH with no topic and no topic alias")
+		}
+		return 0, nil
+	}
+
+	alias := *pb.Properties.TopicAlias
+	if alias == 0 || alias > c.clientProps.TopicAliasMaximum {
+		return packets.DisconnectTopicAliasInvalid, fmt.Errorf(
+			"received PUBLISH with topic alias %d, client topic alias maximum is %d", alias, c.clientProps.TopicAliasMaximum,
+		)
+	}
+	if pb.Topic != "" {
+		c.inboundAliases[alias] = pb.Topic
+		return 0, nil
+	}
+	topic, ok := c.inboundAliases[alias]
+	if !ok {
+		return packets.DisconnectProtocolError, fmt.Errorf("received PUBLISH with unknown topic alias %d", alias)
+	}
+	pb.Topic = topic
+
+	return 0, nil
+}
+
+func (c *Client) isAwaitingRel(id uint16) bool {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	_, ok := c.awaitingRel[id]
+	return ok
+}
+
+// addAwaitingRel records that the Pubrec pr is about to be sent.
+func (c *Client) addAwaitingRel(pr *packets.Pubrec) {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	c.awaitingRel[pr.PacketID] = struct{}{}
+	if c.InboundPersistence != nil {
+		c.InboundPersistence.Put(pr.PacketID, packets.ControlPacket{
+			FixedHeader: packets.FixedHeader{Type: packets.PUBREC},
+			Content:     pr,
+		})
+	}
+}
+
+// removeAwaitingRel releases id and reports whether it was known.
+func (c *Client) removeAwaitingRel(id uint16) bool {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	_, ok := c.awaitingRel[id]
+	delete(c.awaitingRel, id)
+	if c.InboundPersistence != nil {
+		c.InboundPersistence.Delete(id)
+	}
+	return ok
+}
+
+func (c *Client) resetAwaitingRel() {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	c.awaitingRel = make(map[uint16]struct{})
+	c.inboundInflight = 0
+	if c.InboundPersistence != nil {
+		c.InboundPersistence.Reset()
+	}
+}
+
+// addInboundInflight counts a newly received QoS1 or QoS2 Publish and
+// reports whether the server is still within our Receive Maximum.
+func (c *Client) addInboundInflight() bool {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	c.inboundInflight++
+	return c.inboundInflight <= int(c.clientProps.ReceiveMaximum)
+}
+
+func (c *Client) releaseInboundInflight() {
+	c.relMu.Lock()
+	defer c.relMu.Unlock()
+	if c.inboundInflight > 0 {
+		c.inboundInflight--
+	}
+}
+
 func (c *Client) pinger(d time.Duration) {
 	defer func() {
 		c.log(LevelDebug, "pinger stopped")
@@ -570,6 +952,17 @@ func (c *Client) pinger(d time.Duration) {
 	}
 }
 
+// failWithDisconnect sends the server a Disconnect with the given reason
+// code before failing the client with err.
+func (c *Client) failWithDisconnect(ctx context.Context, code byte, err error) {
+	d := packets.Disconnect{
+		ReasonCode: code,
+		Properties: &packets.Properties{},
+	}
+	_ = c.write(ctx, &d)
+	c.fail(ctx, err)
+}
+
 func (c *Client) fail(ctx context.Context, err error) {
 	lvl := LevelError
 	if errors.Is(err, context.Canceled) {
@@ -578,6 +971,7 @@ func (c *Client) fail(ctx context.Context, err error) {
 	c.logCtx(ctx, lvl, "client failed", func(e *LogEntry) {
 		e.Error = err
 	})
+	c.setErr(err)
 	c.close()
 }
 
@@ -648,6 +1042,11 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	if !c.serverProps.SubIDAvailable && s.Properties != nil && s.Properties.SubscriptionIdentifier != nil {
 		return nil, fmt.Errorf("cannot send subscribe with subID set, server does not support subID")
 	}
+	if s.Properties != nil && s.Properties.SubscriptionIdentifier != nil {
+		if id := *s.Properties.SubscriptionIdentifier; id == 0 || id > MaxSubscriptionIdentifier {
+			return nil, fmt.Errorf("cannot send subscribe with subID %d, it must be between 1 and %d", id, MaxSubscriptionIdentifier)
+		}
+	}
 	if !c.serverProps.SharedSubAvailable {
 		for t := range s.Subscriptions {
 			if strings.HasPrefix(t, "$share") {
@@ -696,25 +1095,18 @@ func (c *Client) Subscribe(ctx context.Context, s *Subscribe) (*Suback, error) {
 	}
 
 	sa := SubackFromPacketSuback(sap.Content.(*packets.Suback))
-	switch {
-	case len(sa.Reasons) == 1:
-		if sa.Reasons[0] >= 0x80 {
-			var reason string
+	for _, code := range sa.Reasons {
+		if code >= 0x80 {
 			c.logCtx(ctx, LevelDebug, fmt.Sprintf(
-				"received an error code in Suback: %v", sa.Reasons[0],
+				"received an error code in Suback: %v", code,
 			))
-			if sa.Properties != nil {
-				reason = sa.Properties.ReasonString
-			}
-			return sa, fmt.Errorf("failed to subscribe to topic: %s", reason)
-		}
-	default:
-		for _, code := range sa.Reasons {
-			if code >= 0x80 {
-				c.logCtx(ctx, LevelDebug, fmt.Sprintf(
-					"received an error code in Suback: %v", code,
-				))
-				return sa, fmt.Errorf("at least one requested subscription failed")
+			// With several subscriptions the error carries the first
+			// failure, the others are in the returned Suback.
+			return sa, &ReasonError{
+				PacketType:   packets.SUBACK,
+				Code:         ReasonCode(code),
+				ReasonString: sa.Properties.ReasonString,
+				User:         sa.Properties.User,
 			}
 		}
 	}
@@ -769,25 +1161,16 @@ func (c *Client) Unsubscribe(ctx context.Context, u *Unsubscribe) (*Unsuback, er
 	}
 
 	ua := UnsubackFromPacketUnsuback(uap.Content.(*packets.Unsuback))
-	switch {
-	case len(ua.Reasons) == 1:
-		if ua.Reasons[0] >= 0x80 {
-			var reason string
+	for _, code := range ua.Reasons {
+		if code >= 0x80 {
 			c.logCtx(ctx, LevelDebug, fmt.Sprintf(
-				"received an error code in Unsuback: %v", ua.Reasons[0],
+				"received an error code in Unsuback: %v", code,
 			))
-			if ua.Properties != nil {
-				reason = ua.Properties.ReasonString
-			}
-			return ua, fmt.Errorf("failed to unsubscribe from topic: %s", reason)
-		}
-	default:
-		for _, code := range ua.Reasons {
-			if code >= 0x80 {
-				c.logCtx(ctx, LevelDebug, fmt.Sprintf(
-					"received an error code in Unsuback: %v", code,
-				))
-				return ua, fmt.Errorf("at least one requested unsubscribe failed")
+			return ua, &ReasonError{
+				PacketType:   packets.UNSUBACK,
+				Code:         ReasonCode(code),
+				ReasonString: ua.Properties.ReasonString,
+				User:         ua.Properties.User,
 			}
 		}
 	}
@@ -805,6 +1188,9 @@ func (c *Client) Publish(ctx context.Context, p *Publish) (_ *PublishResponse, e
 		return nil, fmt.Errorf("cannot send Publish with QoS %d, server maximum QoS is %d", p.QoS, c.serverProps.MaximumQoS)
 	}
 	if p.Properties != nil && p.Properties.TopicAlias != nil {
+		if c.AutoTopicAlias {
+			return nil, fmt.Errorf("cannot send publish with TopicAlias %d, topic aliases are assigned automatically", *p.Properties.TopicAlias)
+		}
 		if c.serverProps.TopicAliasMaximum > 0 && *p.Properties.TopicAlias > c.serverProps.TopicAliasMaximum {
 			return nil, fmt.Errorf("cannot send publish with TopicAlias %d, server topic alias maximum is %d", *p.Properties.TopicAlias, c.serverProps.TopicAliasMaximum)
 		}
@@ -852,9 +1238,19 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish) (_ *Publ
 	}()
 
 	if err := c.serverInflight.Acquire(pubCtx, 1); err != nil {
+		c.MIDs.Free(pb.PacketID)
 		return nil, err
 	}
+	// Store the message before it goes on the wire so that it can be
+	// resent if the connection is lost before it is acknowledged.
+	c.Persistence.Put(pb.PacketID, packets.ControlPacket{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBLISH},
+		Content:     pb,
+	})
 	if err := c.write(ctx, pb); err != nil {
+		c.Persistence.Delete(pb.PacketID)
+		c.serverInflight.Release(1)
+		c.MIDs.Free(pb.PacketID)
 		return nil, err
 	}
 
@@ -879,23 +1275,14 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish) (_ *Publ
 		if resp.Type != packets.PUBACK {
 			return nil, fmt.Errorf("received %d instead of PUBACK", resp.Type)
 		}
-		c.serverInflight.Release(1)
 
-		pr := PublishResponseFromPuback(resp.Content.(*packets.Puback))
-		if pr.ReasonCode >= 0x80 {
-			return pr, fmt.Errorf("error publishing: %s", resp.Content.(*packets.Puback).Reason())
-		}
-		return pr, nil
+		return publishResponse(packets.PUBACK, PublishResponseFromPuback(resp.Content.(*packets.Puback)))
 	case 2:
 		switch resp.Type {
 		case packets.PUBCOMP:
-			c.serverInflight.Release(1)
-			pr := PublishResponseFromPubcomp(resp.Content.(*packets.Pubcomp))
-			return pr, nil
+			return publishResponse(packets.PUBCOMP, PublishResponseFromPubcomp(resp.Content.(*packets.Pubcomp)))
 		case packets.PUBREC:
-			c.serverInflight.Release(1)
-			pr := PublishResponseFromPubrec(resp.Content.(*packets.Pubrec))
-			return pr, nil
+			return publishResponse(packets.PUBREC, PublishResponseFromPubrec(resp.Content.(*packets.Pubrec)))
 		default:
 			return nil, fmt.Errorf("received %d instead of PUBCOMP", resp.Type)
 		}
@@ -904,6 +1291,20 @@ func (c *Client) publishQoS12(ctx context.Context, pb *packets.Publish) (_ *Publ
 	return nil, fmt.Errorf("ended up with a non QoS1/2 message: %d", pb.QoS)
 }
 
+// publishResponse returns pr along with a *ReasonError if its reason code,
+// received in a packet of type pt, indicates failure.
+func publishResponse(pt packets.PacketType, pr *PublishResponse) (*PublishResponse, error) {
+	if pr.ReasonCode < 0x80 {
+		return pr, nil
+	}
+	return pr, &ReasonError{
+		PacketType:   pt,
+		Code:         ReasonCode(pr.ReasonCode),
+		ReasonString: pr.Properties.ReasonString,
+		User:         pr.Properties.User,
+	}
+}
+
 // Disconnect is used to send a Disconnect packet to the MQTT server
 // Whether or not the attempt to send the Disconnect packet fails
 // (and if it does this function returns any error) the network connection
@@ -2,6 +2,11 @@ package paho
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -76,8 +81,80 @@ func TestClientConnect(t *testing.T) {
 	ca, err := c.Connect(context.Background(), cp)
 	require.Nil(t, err)
 	assert.Equal(t, uint8(0), ca.ReasonCode)
+	assert.Nil(t, c.Err())
 
 	time.Sleep(10 * time.Millisecond)
+
+	c.Close()
+	assert.Equal(t, ErrClosed, c.Err())
+}
+
+func TestClientAssignedClientID(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		Properties: &packets.Properties{
+			AssignedClientID: "assigned",
+			ResponseInfo:     "responses/assigned",
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	_, err := c.Connect(context.Background(), &Connect{
+		Properties: &ConnectProperties{RequestResponseInfo: true},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.Equal(t, "assigned", c.ClientID())
+	assert.Equal(t, "responses/assigned", c.Connack().Properties.ResponseInfo)
+}
+
+func TestConnectFromPacketConnect(t *testing.T) {
+	cp := ConnectFromPacketConnect(&packets.Connect{
+		Properties: &packets.Properties{
+			RequestResponseInfo: Byte(1),
+			RequestProblemInfo:  Byte(0),
+		},
+	})
+	assert.True(t, cp.Properties.RequestResponseInfo)
+	assert.False(t, cp.Properties.RequestProblemInfo)
+}
+
+func TestClientConnectRefused(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: byte(ReasonNotAuthorized),
+		Properties: &packets.Properties{
+			ReasonString: "denied",
+			User:         map[string]string{"k": "v"},
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ReasonNotAuthorized))
+	assert.True(t, errors.Is(err, &ReasonError{PacketType: packets.CONNACK, Code: ReasonNotAuthorized}))
+	assert.False(t, errors.Is(err, &ReasonError{PacketType: packets.SUBACK, Code: ReasonNotAuthorized}))
+	assert.False(t, errors.Is(err, ReasonBanned))
+
+	var rerr *ReasonError
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, packets.CONNACK, rerr.PacketType)
+	assert.Equal(t, ReasonNotAuthorized, rerr.Code)
+	assert.Equal(t, "denied", rerr.ReasonString)
+	assert.Equal(t, map[string]string{"k": "v"}, rerr.User)
+	assert.Equal(t, "CONNACK: not authorized (0x87): denied", err.Error())
+	<-c.Done()
+	assert.Equal(t, err, c.Err())
 }
 
 func TestClientSubscribe(t *testing.T) {
@@ -110,6 +187,39 @@ func TestClientSubscribe(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
+func TestClientSubscribeFailure(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.SUBACK, &packets.Suback{
+		Reasons:    []byte{1, byte(ReasonTopicFilterInvalid)},
+		Properties: &packets.Properties{ReasonString: "bad filter"},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	s := &Subscribe{
+		Subscriptions: map[string]SubscribeOptions{
+			"test/1":  {QoS: 1},
+			"test/#/": {QoS: 1},
+		},
+	}
+
+	sa, err := c.Subscribe(context.Background(), s)
+	require.Error(t, err)
+	assert.Equal(t, []byte{1, byte(ReasonTopicFilterInvalid)}, sa.Reasons)
+
+	var rerr *ReasonError
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, packets.SUBACK, rerr.PacketType)
+	assert.Equal(t, ReasonTopicFilterInvalid, rerr.Code)
+	assert.Equal(t, "bad filter", rerr.ReasonString)
+}
+
 func TestClientUnsubscribe(t *testing.T) {
 	ts := newTestServer()
 	ts.SetResponse(packets.UNSUBACK, &packets.Unsuback{
@@ -165,6 +275,50 @@ func TestClientPublishQoS0(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
+// countingConn counts the calls to Write.
+type countingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestClientWritesWholePackets(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	conn := &countingConn{Conn: ts.ClientConn()}
+	c := NewClient(ClientConfig{
+		Conn: conn,
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	_, err = c.Publish(context.Background(), &Publish{
+		Topic:      "test/1",
+		QoS:        1,
+		Payload:    []byte("test payload"),
+		Properties: &PublishProperties{ContentType: "text/plain"},
+	})
+	require.NoError(t, err)
+
+	// One Write for the Connect and one for the Publish.
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	assert.Equal(t, 2, conn.writes)
+}
+
 func TestClientPublishQoS1(t *testing.T) {
 	ts := newTestServer()
 	ts.SetResponse(packets.PUBACK, &packets.Puback{
@@ -196,6 +350,33 @@ func TestClientPublishQoS1(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
+func TestClientPublishQoS1Failure(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackQuotaExceeded,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	p := &Publish{
+		Topic:   "test/1",
+		QoS:     1,
+		Payload: []byte("test payload"),
+	}
+
+	pa, err := c.Publish(context.Background(), p)
+	require.Error(t, err)
+	assert.Equal(t, uint8(ReasonQuotaExceeded), pa.ReasonCode)
+	assert.True(t, errors.Is(err, ReasonQuotaExceeded))
+}
+
 func TestClientPublishQoS2(t *testing.T) {
 	ts := newTestServer()
 	ts.SetResponse(packets.PUBREC, &packets.Pubrec{
@@ -231,6 +412,216 @@ func TestClientPublishQoS2(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 }
 
+func TestClientPublishQoS2Persistence(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.PUBREC, &packets.Pubrec{
+		ReasonCode: packets.PubrecSuccess,
+		Properties: &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBCOMP, &packets.Pubcomp{
+		ReasonCode: packets.PubcompSuccess,
+		Properties: &packets.Properties{},
+	})
+	stored := make(chan packets.PacketType, 2)
+	mp := &MemoryPersistence{}
+	mp.Open()
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.PUBLISH || cp.Type == packets.PUBREL {
+			// Whatever is on the wire must already be persisted.
+			stored <- mp.Get(cp.PacketID()).Type
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:        ts.ClientConn(),
+		Persistence: mp,
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	_, err = c.Publish(context.Background(), &Publish{
+		Topic:   "test/2",
+		QoS:     2,
+		Payload: []byte("test payload"),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, packets.PUBLISH, <-stored)
+	assert.Equal(t, packets.PUBREL, <-stored)
+	assert.Nil(t, mp.Get(1).Content)
+}
+
+// sessionPersistence is a MemoryPersistence whose All returns the packets
+// left by a previous session.
+type sessionPersistence struct {
+	MemoryPersistence
+	session []packets.ControlPacket
+}
+
+func (p *sessionPersistence) All() []packets.ControlPacket {
+	return p.session
+}
+
+func TestClientResendSession(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		SessionPresent: true,
+		Properties:     &packets.Properties{},
+	})
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	resent := make(chan *packets.Publish, 1)
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.PUBLISH {
+			resent <- cp.Content.(*packets.Publish)
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	mp := &sessionPersistence{}
+	mp.Open()
+	mp.session = []packets.ControlPacket{{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBLISH},
+		Content: &packets.Publish{
+			PacketID:   5,
+			QoS:        1,
+			Topic:      "test/1",
+			Payload:    []byte("test payload"),
+			Properties: &packets.Properties{},
+		},
+	}}
+	mp.Put(5, mp.session[0])
+
+	c := NewClient(ClientConfig{
+		Conn:        ts.ClientConn(),
+		Persistence: mp,
+	})
+	_, err := c.Connect(context.Background(), &Connect{CleanStart: false})
+	require.NoError(t, err)
+
+	pb := <-resent
+	assert.Equal(t, uint16(5), pb.PacketID)
+	assert.True(t, pb.Duplicate)
+	assert.Equal(t, "test/1", pb.Topic)
+
+	for i := 0; mp.Get(5).Content != nil; i++ {
+		require.True(t, i < 100, "resent message was not removed from persistence")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientResendSessionNoClaim(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		SessionPresent: true,
+		Properties:     &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	mp := &sessionPersistence{}
+	mp.Open()
+	mp.session = []packets.ControlPacket{testPublish(5, "test/1")}
+
+	// Only the MIDService methods are promoted, not Claim.
+	c := NewClient(ClientConfig{
+		Conn:        ts.ClientConn(),
+		MIDs:        struct{ MIDService }{&MIDs{index: make(map[uint16]*CPContext)}},
+		Persistence: mp,
+	})
+	_, err := c.Connect(context.Background(), &Connect{CleanStart: false})
+	assert.Error(t, err)
+}
+
+func TestClientAutoTopicAlias(t *testing.T) {
+	published := make(chan *packets.Publish, 10)
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: 0,
+		Properties: &packets.Properties{
+			TopicAliasMaximum: Uint16(2),
+		},
+	})
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.PUBLISH {
+			published <- cp.Content.(*packets.Publish)
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:           ts.ClientConn(),
+		AutoTopicAlias: true,
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	_, err = c.Publish(context.Background(), &Publish{
+		Topic:      "test/0",
+		Properties: &PublishProperties{TopicAlias: Uint16(1)},
+	})
+	require.Error(t, err)
+
+	expected := []struct {
+		topic string
+		sent  string
+		alias uint16
+	}{
+		{"test/a", "test/a", 1},
+		{"test/b", "test/b", 2},
+		{"test/a", "", 1},
+		{"test/c", "test/c", 2}, // replaces test/b, the least recently used.
+		{"test/b", "test/b", 1}, // replaces test/a.
+		{"test/c", "", 2},
+	}
+	for _, e := range expected {
+		p := &Publish{Topic: e.topic, Payload: []byte("test payload")}
+		_, err := c.Publish(context.Background(), p)
+		require.NoError(t, err)
+		assert.Equal(t, e.topic, p.Topic)
+
+		pb := <-published
+		assert.Equal(t, e.sent, pb.Topic)
+		require.NotNil(t, pb.Properties.TopicAlias)
+		assert.Equal(t, e.alias, *pb.Properties.TopicAlias)
+	}
+}
+
+func TestClientPublishTooLarge(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.CONNACK, &packets.Connack{
+		ReasonCode: 0,
+		Properties: &packets.Properties{
+			MaximumPacketSize: Uint32(100),
+		},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	for _, qos := range []byte{0, 1} {
+		_, err = c.Publish(context.Background(), &Publish{
+			Topic:   "test/1",
+			QoS:     qos,
+			Payload: make([]byte, 100),
+		})
+		require.IsType(t, &packets.PacketTooLargeError{}, err)
+		assert.Equal(t, packets.PUBLISH, err.(*packets.PacketTooLargeError).Type)
+	}
+	assert.Empty(t, c.Persistence.All())
+}
+
 func TestClientReceiveQoS0(t *testing.T) {
 	rChan := make(chan struct{})
 	ts := newTestServer()
@@ -243,6 +634,7 @@ func TestClientReceiveQoS0(t *testing.T) {
 			assert.Equal(t, "test/0", p.Topic)
 			assert.Equal(t, "test payload", string(p.Payload))
 			assert.Equal(t, byte(0), p.QoS)
+			assert.WithinDuration(t, time.Now(), p.ReceivedAt, time.Second)
 			close(rChan)
 		}),
 	})
@@ -293,6 +685,199 @@ func TestClientReceiveQoS1(t *testing.T) {
 	<-rChan
 }
 
+func TestClientDispatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       DispatchMode
+		workers    int
+		concurrent int  // the most Route calls allowed at once.
+		ordered    bool // whether the order of all Publishes is kept.
+	}{
+		{"concurrent", DispatchConcurrent, 0, DefaultWorkers, false},
+		{"concurrent workers", DispatchConcurrent, 2, 2, false},
+		{"sequential", DispatchSequential, 0, 1, true},
+		{"pool", DispatchWorkerPool, 3, 3, false},
+		{"topic", DispatchByTopic, 3, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 60
+			var (
+				mu       sync.Mutex
+				running  int
+				max      int
+				received []string
+				byTopic  = make(map[string][]string)
+				done     = make(chan struct{})
+			)
+			ts := newTestServer()
+			go ts.Run()
+			defer ts.Stop()
+
+			c := NewClient(ClientConfig{
+				Conn:     ts.ClientConn(),
+				Dispatch: tt.mode,
+				Workers:  tt.workers,
+				Router: RouterFunc(func(p *packets.Publish, _ func() error) {
+					mu.Lock()
+					running++
+					if running > max {
+						max = running
+					}
+					mu.Unlock()
+					time.Sleep(time.Millisecond)
+					mu.Lock()
+					defer mu.Unlock()
+					running--
+					received = append(received, string(p.Payload))
+					byTopic[p.Topic] = append(byTopic[p.Topic], string(p.Payload))
+					if len(received) == n {
+						close(done)
+					}
+				}),
+			})
+			_, err := c.Connect(context.Background(), new(Connect))
+			require.NoError(t, err)
+
+			var sent []string
+			for i := 0; i < n; i++ {
+				topic := fmt.Sprintf("test/%d", i%4)
+				payload := fmt.Sprintf("%s:%d", topic, i)
+				sent = append(sent, payload)
+				require.NoError(t, ts.SendPacket(&packets.Publish{Topic: topic, Payload: []byte(payload)}))
+			}
+			<-done
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.True(t, max <= tt.concurrent, "%d concurrent Route calls", max)
+			if tt.ordered {
+				assert.Equal(t, sent, received)
+			}
+			if tt.mode == DispatchByTopic {
+				for topic, payloads := range byTopic {
+					var want []string
+					for _, p := range sent {
+						if strings.HasPrefix(p, topic+":") {
+							want = append(want, p)
+						}
+					}
+					assert.Equal(t, want, payloads, topic)
+				}
+			}
+		})
+	}
+}
+
+// ackTestServer returns a test server recording the packet ids of the
+// Pubacks it receives.
+func ackTestServer() (*testServer, chan uint16) {
+	pubacks := make(chan uint16, 10)
+	ts := newTestServer()
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.PUBACK {
+			pubacks <- cp.PacketID()
+		}
+	})
+	return ts, pubacks
+}
+
+func TestClientAckOrdered(t *testing.T) {
+	ts, pubacks := ackTestServer()
+	go ts.Run()
+	defer ts.Stop()
+
+	acks := make(chan *packets.Publish, 3)
+	ackFuncs := make(map[uint16]func() error)
+	var mu sync.Mutex
+	c := NewClient(ClientConfig{
+		Conn:    ts.ClientConn(),
+		AckMode: AckOrdered,
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			mu.Lock()
+			ackFuncs[p.PacketID] = ack
+			mu.Unlock()
+			acks <- p
+		}),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+	c.clientInflight = semaphore.NewWeighted(10000)
+
+	for id := uint16(1); id <= 3; id++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: id, Topic: "test/1", QoS: 1}))
+	}
+	for i := 0; i < 3; i++ {
+		<-acks
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NoError(t, ackFuncs[3]())
+	require.NoError(t, ackFuncs[2]())
+	select {
+	case id := <-pubacks:
+		t.Fatalf("PUBACK %d sent before PUBACK 1", id)
+	case <-time.After(20 * time.Millisecond):
+	}
+	require.NoError(t, ackFuncs[1]())
+	assert.Equal(t, uint16(1), <-pubacks)
+	assert.Equal(t, uint16(2), <-pubacks)
+	assert.Equal(t, uint16(3), <-pubacks)
+}
+
+func TestClientAckOrderedTimeout(t *testing.T) {
+	ts, pubacks := ackTestServer()
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:       ts.ClientConn(),
+		AckMode:    AckOrdered,
+		AckTimeout: 20 * time.Millisecond,
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			// The first Publish is never acknowledged.
+			if p.PacketID != 1 {
+				_ = ack()
+			}
+		}),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+	c.clientInflight = semaphore.NewWeighted(10000)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "test/1", QoS: 1}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 2, Topic: "test/1", QoS: 1}))
+	assert.Equal(t, uint16(1), <-pubacks)
+	assert.Equal(t, uint16(2), <-pubacks)
+}
+
+func TestClientAckAuto(t *testing.T) {
+	ts, pubacks := ackTestServer()
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn:     ts.ClientConn(),
+		AckMode:  AckAuto,
+		Dispatch: DispatchWorkerPool,
+		Router: RouterFunc(func(p *packets.Publish, _ func() error) {
+			// The first Publish takes longer to handle.
+			if p.PacketID == 1 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+	c.clientInflight = semaphore.NewWeighted(10000)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 1, Topic: "test/1", QoS: 1}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{PacketID: 2, Topic: "test/1", QoS: 1}))
+	assert.Equal(t, uint16(1), <-pubacks)
+	assert.Equal(t, uint16(2), <-pubacks)
+}
+
 func TestClientReceiveQoS2(t *testing.T) {
 	rChan := make(chan struct{})
 	ts := newTestServer()
@@ -324,8 +909,257 @@ func TestClientReceiveQoS2(t *testing.T) {
 	<-rChan
 }
 
+func TestClientReceiveQoS2Duplicate(t *testing.T) {
+	routed := make(chan struct{}, 2)
+	acks := make(chan *packets.ControlPacket, 4)
+	ts := newTestServer()
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.PUBREC || cp.Type == packets.PUBCOMP {
+			acks <- cp
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	mp := &MemoryPersistence{}
+	mp.Open()
+	c := NewClient(ClientConfig{
+		Conn:               ts.ClientConn(),
+		InboundPersistence: mp,
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			routed <- struct{}{}
+			assert.NoError(t, ack())
+		}),
+	})
+	_, err := c.Connect(context.Background(), new(Connect))
+	require.NoError(t, err)
+
+	pb := &packets.Publish{
+		PacketID: 7,
+		Topic:    "test/2",
+		QoS:      2,
+		Payload:  []byte("test payload"),
+	}
+	require.NoError(t, ts.SendPacket(pb))
+	<-routed
+	assert.Equal(t, packets.PUBREC, (<-acks).Type)
+	assert.Equal(t, packets.PUBREC, mp.Get(7).Type)
+
+	pb.Duplicate = true
+	require.NoError(t, ts.SendPacket(pb))
+	assert.Equal(t, packets.PUBREC, (<-acks).Type)
+
+	require.NoError(t, ts.SendPacket(&packets.Pubrel{PacketID: 7}))
+	pc := <-acks
+	require.Equal(t, packets.PUBCOMP, pc.Type)
+	assert.Equal(t, byte(packets.PubcompSuccess), pc.Content.(*packets.Pubcomp).ReasonCode)
+	assert.Nil(t, mp.Get(7).Content)
+
+	require.NoError(t, ts.SendPacket(&packets.Pubrel{PacketID: 7}))
+	pc = <-acks
+	require.Equal(t, packets.PUBCOMP, pc.Type)
+	assert.Equal(t, byte(packets.PubcompPacketIdentifierNotFound), pc.Content.(*packets.Pubcomp).ReasonCode)
+
+	assert.Len(t, routed, 0)
+}
+
+func TestClientReceiveMaximumExceeded(t *testing.T) {
+	disconnect := make(chan *packets.Disconnect, 1)
+	ts := newTestServer()
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.DISCONNECT {
+			disconnect <- cp.Content.(*packets.Disconnect)
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			// Never acknowledge, so the message stays in flight.
+		}),
+	})
+	_, err := c.Connect(context.Background(), &Connect{
+		Properties: &ConnectProperties{
+			ReceiveMaximum: Uint16(1),
+		},
+	})
+	require.NoError(t, err)
+
+	for id := uint16(1); id <= 2; id++ {
+		require.NoError(t, ts.SendPacket(&packets.Publish{
+			PacketID: id,
+			Topic:    "test/1",
+			QoS:      1,
+			Payload:  []byte("test payload"),
+		}))
+	}
+
+	d := <-disconnect
+	assert.Equal(t, byte(packets.DisconnectReceiveMaximumExceeded), d.ReasonCode)
+	<-c.Done()
+}
+
+func TestClientReceiveMaximumKeepsReading(t *testing.T) {
+	ts := newTestServer()
+	ts.SetResponse(packets.PUBACK, &packets.Puback{
+		ReasonCode: packets.PubackSuccess,
+		Properties: &packets.Properties{},
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	var c *Client
+	published := make(chan error, 1)
+	routed := make(chan string, 2)
+	c = NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			if p.Topic == "test/1" {
+				// The Puback is only read if the reader is not waiting for
+				// the Router to be done with this Publish.
+				_, err := c.Publish(context.Background(), &Publish{Topic: "test/reply", QoS: 1})
+				published <- err
+			}
+			routed <- p.Topic
+		}),
+	})
+	_, err := c.Connect(context.Background(), &Connect{
+		Properties: &ConnectProperties{
+			ReceiveMaximum: Uint16(1),
+		},
+	})
+	require.NoError(t, err)
+
+	for _, topic := range []string{"test/1", "test/2"} {
+		require.NoError(t, ts.SendPacket(&packets.Publish{Topic: topic, Payload: []byte("test payload")}))
+	}
+
+	select {
+	case err := <-published:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing from the Router timed out")
+	}
+	assert.ElementsMatch(t, []string{"test/1", "test/2"}, []string{<-routed, <-routed})
+}
+
+func TestClientReceiveTopicAlias(t *testing.T) {
+	ts := newTestServer()
+	go ts.Run()
+	defer ts.Stop()
+
+	topics := make(chan string, 2)
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			topics <- p.Topic
+		}),
+	})
+	_, err := c.Connect(context.Background(), &Connect{
+		Properties: &ConnectProperties{
+			TopicAliasMaximum: Uint16(1),
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, ts.SendPacket(&packets.Publish{
+		Topic:      "test/1",
+		Properties: &packets.Properties{TopicAlias: Uint16(1)},
+	}))
+	require.NoError(t, ts.SendPacket(&packets.Publish{
+		Properties: &packets.Properties{TopicAlias: Uint16(1)},
+	}))
+	assert.Equal(t, "test/1", <-topics)
+	assert.Equal(t, "test/1", <-topics)
+}
+
+func TestClientReceiveTopicAliasInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		topic string
+		alias uint16
+		code  byte
+	}{
+		{"zero", "test/1", 0, packets.DisconnectTopicAliasInvalid},
+		{"above maximum", "test/1", 2, packets.DisconnectTopicAliasInvalid},
+		{"unknown", "", 1, packets.DisconnectProtocolError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			disconnect := make(chan *packets.Disconnect, 1)
+			ts := newTestServer()
+			ts.OnReceive(func(cp *packets.ControlPacket) {
+				if cp.Type == packets.DISCONNECT {
+					disconnect <- cp.Content.(*packets.Disconnect)
+				}
+			})
+			go ts.Run()
+			defer ts.Stop()
+
+			c := NewClient(ClientConfig{
+				Conn: ts.ClientConn(),
+				Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+					t.Errorf("unexpected publish on %q", p.Topic)
+				}),
+			})
+			_, err := c.Connect(context.Background(), &Connect{
+				Properties: &ConnectProperties{
+					TopicAliasMaximum: Uint16(1),
+				},
+			})
+			require.NoError(t, err)
+
+			// The client may drop the connection before the write returns.
+			_ = ts.SendPacket(&packets.Publish{
+				Topic:      tc.topic,
+				Properties: &packets.Properties{TopicAlias: Uint16(tc.alias)},
+			})
+			d := <-disconnect
+			assert.Equal(t, tc.code, d.ReasonCode)
+			<-c.Done()
+		})
+	}
+}
+
+func TestClientReceiveTooLarge(t *testing.T) {
+	disconnect := make(chan *packets.Disconnect, 1)
+	ts := newTestServer()
+	ts.OnReceive(func(cp *packets.ControlPacket) {
+		if cp.Type == packets.DISCONNECT {
+			disconnect <- cp.Content.(*packets.Disconnect)
+		}
+	})
+	go ts.Run()
+	defer ts.Stop()
+
+	c := NewClient(ClientConfig{
+		Conn: ts.ClientConn(),
+		Router: RouterFunc(func(p *packets.Publish, ack func() error) {
+			t.Errorf("unexpected publish on %q", p.Topic)
+		}),
+	})
+	_, err := c.Connect(context.Background(), &Connect{
+		Properties: &ConnectProperties{
+			MaximumPacketSize: Uint32(100),
+		},
+	})
+	require.NoError(t, err)
+
+	// The client may drop the connection before the write returns.
+	_ = ts.SendPacket(&packets.Publish{
+		Topic:      "test/1",
+		Payload:    make([]byte, 100),
+		Properties: &packets.Properties{},
+	})
+	d := <-disconnect
+	assert.Equal(t, byte(packets.DisconnectPacketTooLarge), d.ReasonCode)
+	<-c.Done()
+}
+
 func TestReceiveServerDisconnect(t *testing.T) {
 	rChan := make(chan struct{})
+	var disconnect *Disconnect
 	ts := newTestServer()
 	go ts.Run()
 	defer ts.Stop()
@@ -335,6 +1169,9 @@ func TestReceiveServerDisconnect(t *testing.T) {
 		OnClose: func() {
 			close(rChan)
 		},
+		OnServerDisconnect: func(d *Disconnect) {
+			disconnect = d
+		},
 	})
 	_, err := c.Connect(context.Background(), new(Connect))
 	require.NoError(t, err)
@@ -351,6 +1188,16 @@ func TestReceiveServerDisconnect(t *testing.T) {
 	require.NoError(t, err)
 
 	<-rChan
+	require.NotNil(t, disconnect)
+	assert.Equal(t, byte(packets.DisconnectServerShuttingDown), disconnect.ReasonCode)
+	assert.Equal(t, "GONE!", disconnect.Properties.ReasonString)
+
+	err = c.Err()
+	var derr *DisconnectError
+	require.True(t, errors.As(err, &derr))
+	assert.Equal(t, disconnect, derr.Disconnect)
+	assert.True(t, errors.Is(err, ReasonServerShuttingDown))
+	assert.Equal(t, "received server initiated disconnect: server shutting down (0x8B): GONE!", err.Error())
 }
 
 func TestAuthenticate(t *testing.T) {
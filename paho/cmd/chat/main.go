@@ -7,19 +7,20 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+	"github.com/netdata/paho.golang/paho/transport"
 )
 
 func main() {
 	stdin := bufio.NewReader(os.Stdin)
 	hostname, _ := os.Hostname()
 
-	server := flag.String("server", "127.0.0.1:1883", "The full URL of the MQTT server to connect to")
+	server := flag.String("server", "mqtt://127.0.0.1:1883", "The full URL of the MQTT server to connect to ex: mqtts://127.0.0.1:8883")
 	topic := flag.String("topic", hostname, "Topic to publish and receive the messages on")
 	qos := flag.Int("qos", 0, "The QoS to send the messages at")
 	//name := flag.String("chatname", hostname, "The name to attach to your messages")
@@ -28,14 +29,20 @@ func main() {
 	password := flag.String("password", "", "Password to match username")
 	flag.Parse()
 
-	conn, err := net.Dial("tcp", *server)
+	u, err := transport.ParseURL(*server)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d := &transport.Dialer{Proxy: transport.ProxyFromEnvironment}
+	conn, err := d.Dial(context.Background(), u)
 	if err != nil {
 		log.Fatalf("Failed to connect to %s: %s", *server, err)
 	}
 
 	c := paho.NewClient(paho.ClientConfig{
-		Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
+		Router: rpc.NewSingleHandlerRouter(func(m *paho.Publish, ack func() error) {
 			log.Printf("%s : %s", m.Properties.User["chatname"], string(m.Payload))
+			_ = ack()
 		}),
 		Conn: conn,
 	})
@@ -72,7 +79,7 @@ func main() {
 		fmt.Println("signal received, exiting")
 		if c != nil {
 			d := &paho.Disconnect{ReasonCode: 0}
-			err := c.Disconnect(d)
+			err := c.Disconnect(context.Background(), d)
 			if err != nil {
 				log.Fatalf("failed to send Disconnect: %s", err)
 			}
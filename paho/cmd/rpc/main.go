@@ -1,13 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"sync"
@@ -15,7 +12,9 @@ import (
 	"time"
 
 	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/codec"
 	"github.com/netdata/paho.golang/paho/extensions/rpc"
+	"github.com/netdata/paho.golang/paho/transport"
 )
 
 func init() {
@@ -28,63 +27,55 @@ func init() {
 }
 
 type Request struct {
-	Function string `json:"function"`
-	Param1   int    `json:"param1"`
-	Param2   int    `json:"param2"`
+	Param1 int `json:"param1"`
+	Param2 int `json:"param2"`
 }
 
 type Response struct {
 	Value int `json:"value"`
 }
 
+// arithmetic returns a handler computing op on the parameters of the
+// request.
+func arithmetic(op func(a, b int) (int, error)) rpc.HandlerFunc {
+	return func(_ context.Context, req *rpc.Request) (*rpc.Response, error) {
+		log.Printf("Received %s request\n%s", req.Method, string(req.Payload))
+
+		var r Request
+		if err := codec.Default.Decode(req.Publish, &r); err != nil {
+			return nil, &rpc.Error{Code: "bad_request", Message: fmt.Sprintf("failed to decode request: %s", err)}
+		}
+		v, err := op(r.Param1, r.Param2)
+		if err != nil {
+			return nil, err
+		}
+		body, err := codec.Default.Encode(codec.ContentTypeJSON, Response{Value: v})
+		if err != nil {
+			return nil, err
+		}
+		return &rpc.Response{Payload: body, ContentType: codec.ContentTypeJSON}, nil
+	}
+}
+
 func listener(server, rTopic, username, password string) {
 	var v sync.WaitGroup
 
 	v.Add(1)
 
 	go func() {
-		conn, err := net.Dial("tcp", server)
+		u, err := transport.ParseURL(server)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		d := &transport.Dialer{Proxy: transport.ProxyFromEnvironment}
+		conn, err := d.Dial(context.Background(), u)
 		if err != nil {
 			log.Fatalf("Failed to connect to %s: %s", server, err)
 		}
 
 		c := paho.NewClient(paho.ClientConfig{
-			Conn: conn,
-		})
-		c.Router = paho.NewSingleHandlerRouter(func(m *paho.Publish) {
-			if m.Properties != nil && m.Properties.CorrelationData != nil && m.Properties.ResponseTopic != "" {
-				log.Printf("Received message with response topic %s and correl id %s\n%s", m.Properties.ResponseTopic, string(m.Properties.CorrelationData), string(m.Payload))
-
-				var r Request
-				var resp Response
-
-				if err := json.NewDecoder(bytes.NewReader(m.Payload)).Decode(&r); err != nil {
-					log.Printf("Failed to decode Request: %v", err)
-				}
-
-				switch r.Function {
-				case "add":
-					resp.Value = r.Param1 + r.Param2
-				case "mul":
-					resp.Value = r.Param1 * r.Param2
-				case "div":
-					resp.Value = r.Param1 / r.Param2
-				case "sub":
-					resp.Value = r.Param1 - r.Param2
-				}
-
-				body, _ := json.Marshal(resp)
-				_, err := c.Publish(context.Background(), &paho.Publish{
-					Properties: &paho.PublishProperties{
-						CorrelationData: m.Properties.CorrelationData,
-					},
-					Topic:   m.Properties.ResponseTopic,
-					Payload: body,
-				})
-				if err != nil {
-					log.Fatalf("failed to publish message: %s", err)
-				}
-			}
+			Conn:   conn,
+			Router: rpc.NewStandardRouter(),
 		})
 
 		cp := &paho.Connect{
@@ -112,12 +103,24 @@ func listener(server, rTopic, username, password string) {
 
 		fmt.Printf("Connected to %s\n", server)
 
-		_, err = c.Subscribe(context.Background(), &paho.Subscribe{
-			Subscriptions: map[string]paho.SubscribeOptions{
-				rTopic: paho.SubscribeOptions{QoS: 0},
-			},
+		s, err := rpc.NewServer(rpc.ServerOpts{
+			Conn:  c,
+			Topic: rTopic,
+			Group: "listeners",
 		})
 		if err != nil {
+			log.Fatal(err)
+		}
+		s.Handle("add", arithmetic(func(a, b int) (int, error) { return a + b, nil }))
+		s.Handle("sub", arithmetic(func(a, b int) (int, error) { return a - b, nil }))
+		s.Handle("mul", arithmetic(func(a, b int) (int, error) { return a * b, nil }))
+		s.Handle("div", arithmetic(func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, &rpc.Error{Code: "div_by_zero", Message: "division by zero"}
+			}
+			return a / b, nil
+		}))
+		if err := s.Start(context.Background()); err != nil {
 			log.Fatalf("failed to subscribe: %s", err)
 		}
 
@@ -132,7 +135,7 @@ func listener(server, rTopic, username, password string) {
 }
 
 func main() {
-	server := flag.String("server", "127.0.0.1:1883", "The full URL of the MQTT server to connect to")
+	server := flag.String("server", "mqtt://127.0.0.1:1883", "The full URL of the MQTT server to connect to ex: mqtts://127.0.0.1:8883")
 	rTopic := flag.String("rtopic", "rpc/request", "Topic for requests to go to")
 	username := flag.String("username", "", "A username to authenticate to the MQTT server")
 	password := flag.String("password", "", "Password to match username")
@@ -142,22 +145,30 @@ func main() {
 
 	listener(*server, *rTopic, *username, *password)
 
-	conn, err := net.Dial("tcp", *server)
+	u, err := transport.ParseURL(*server)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d := &transport.Dialer{Proxy: transport.ProxyFromEnvironment}
+	conn, err := d.Dial(context.Background(), u)
 	if err != nil {
 		log.Fatalf("Failed to connect to %s: %s", *server, err)
 	}
 
 	c := paho.NewClient(paho.ClientConfig{
-		Router: paho.NewSingleHandlerRouter(nil),
+		Router: rpc.NewStandardRouter(),
 		Conn:   conn,
 	})
 
+	// The client identifier is left for the server to assign, and the
+	// response topic is placed under the Response Information it sends.
 	cp := &paho.Connect{
 		KeepAlive:  30,
 		CleanStart: true,
 		Username:   *username,
 		Password:   []byte(*password),
 	}
+	rpc.RequestResponseInfo(cp)
 
 	if *username != "" {
 		cp.UsernameFlag = true
@@ -176,15 +187,16 @@ func main() {
 
 	fmt.Printf("Connected to %s\n", *server)
 
-	h, err := rpc.NewHandler(c)
+	h, err := rpc.NewHandler(context.Background(), rpc.HandlerOpts{
+		Conn: c,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	resp, err := h.Request(&paho.Publish{
-		Topic:   *rTopic,
-		Payload: []byte(`{"function":"mul", "param1": 10, "param2": 5}`),
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := h.Call(ctx, *rTopic, "mul", []byte(`{"param1": 10, "param2": 5}`))
 	if err != nil {
 		log.Fatal(err)
 	}
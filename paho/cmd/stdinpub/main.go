@@ -7,19 +7,19 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/transport"
 )
 
 func main() {
 	stdin := bufio.NewReader(os.Stdin)
 	hostname, _ := os.Hostname()
 
-	server := flag.String("server", "127.0.0.1:1883", "The full URL of the MQTT server to connect to")
+	server := flag.String("server", "mqtt://127.0.0.1:1883", "The full URL of the MQTT server to connect to ex: mqtts://127.0.0.1:8883")
 	topic := flag.String("topic", hostname, "Topic to publish the messages on")
 	qos := flag.Int("qos", 0, "The QoS to send the messages at")
 	retained := flag.Bool("retained", false, "Are the messages sent with the retained flag")
@@ -28,7 +28,12 @@ func main() {
 	password := flag.String("password", "", "Password to match username")
 	flag.Parse()
 
-	conn, err := net.Dial("tcp", *server)
+	u, err := transport.ParseURL(*server)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d := &transport.Dialer{Proxy: transport.ProxyFromEnvironment}
+	conn, err := d.Dial(context.Background(), u)
 	if err != nil {
 		log.Fatalf("Failed to connect to %s: %s", *server, err)
 	}
@@ -71,7 +76,7 @@ func main() {
 		fmt.Println("signal received, exiting")
 		if c != nil {
 			d := &paho.Disconnect{ReasonCode: 0}
-			c.Disconnect(d)
+			c.Disconnect(context.Background(), d)
 		}
 		os.Exit(0)
 	}()
@@ -5,16 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+	"github.com/netdata/paho.golang/paho/transport"
 )
 
 func main() {
-	server := flag.String("server", "127.0.0.1:1883", "The MQTT server to connect to ex: 127.0.0.1:1883")
+	server := flag.String("server", "mqtt://127.0.0.1:1883", "The full URL of the MQTT server to connect to ex: mqtts://127.0.0.1:8883")
 	topic := flag.String("topic", "#", "Topic to subscribe to")
 	qos := flag.Int("qos", 0, "The QoS to subscribe to messages at")
 	clientid := flag.String("clientid", "", "A clientid for the connection")
@@ -24,20 +25,31 @@ func main() {
 
 	logger := log.New(os.Stdout, "SUB: ", log.LstdFlags)
 
-	paho.SetDebugLogger(logger)
-	paho.SetErrorLogger(logger)
 	msgChan := make(chan *paho.Publish)
 
-	conn, err := net.Dial("tcp", *server)
+	u, err := transport.ParseURL(*server)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	d := &transport.Dialer{Proxy: transport.ProxyFromEnvironment}
+	conn, err := d.Dial(context.Background(), u)
 	if err != nil {
 		log.Fatalf("Failed to connect to %s: %s", *server, err)
 	}
 
 	c := paho.NewClient(paho.ClientConfig{
-		Router: paho.NewSingleHandlerRouter(func(m *paho.Publish) {
+		Router: rpc.NewSingleHandlerRouter(func(m *paho.Publish, ack func() error) {
 			msgChan <- m
+			_ = ack()
 		}),
 		Conn: conn,
+		Logger: func(_ context.Context, e paho.LogEntry) {
+			if e.Error != nil {
+				logger.Println(e.Message, e.Error)
+			} else {
+				logger.Println(e.Message)
+			}
+		},
 	})
 
 	cp := &paho.Connect{
@@ -72,7 +84,7 @@ func main() {
 		fmt.Println("signal received, exiting")
 		if c != nil {
 			d := &paho.Disconnect{ReasonCode: 0}
-			c.Disconnect(d)
+			c.Disconnect(context.Background(), d)
 		}
 		os.Exit(0)
 	}()
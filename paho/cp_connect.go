@@ -53,7 +53,7 @@ func (c *Connect) InitProperties(p *packets.Properties) {
 	}
 
 	if p.RequestResponseInfo != nil {
-		c.Properties.RequestResponseInfo = *p.RequestProblemInfo == 1
+		c.Properties.RequestResponseInfo = *p.RequestResponseInfo == 1
 	}
 	if p.RequestProblemInfo != nil {
 		c.Properties.RequestProblemInfo = *p.RequestProblemInfo == 1
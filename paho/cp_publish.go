@@ -3,6 +3,7 @@ package paho
 import (
 	"bytes"
 	"fmt"
+	"time"
 
 	"github.com/netdata/paho.golang/packets"
 )
@@ -15,19 +16,24 @@ type (
 		Topic      string
 		Properties *PublishProperties
 		Payload    []byte
+		// ReceivedAt is the time the client read the Publish from the
+		// network, it is zero for the Publishes it sends.
+		ReceivedAt time.Time
 	}
 
 	// PublishProperties is a struct of the properties that can be set
 	// for a Publish packet
 	PublishProperties struct {
-		CorrelationData        []byte
-		ContentType            string
-		ResponseTopic          string
-		PayloadFormat          *byte
-		MessageExpiry          *uint32
-		SubscriptionIdentifier *uint32
-		TopicAlias             *uint16
-		User                   map[string]string
+		CorrelationData []byte
+		ContentType     string
+		ResponseTopic   string
+		PayloadFormat   *byte
+		MessageExpiry   *uint32
+		// SubscriptionIdentifiers are set on received Publishes to the
+		// identifiers of the subscriptions they matched.
+		SubscriptionIdentifiers []uint32
+		TopicAlias              *uint16
+		User                    map[string]string
 	}
 )
 
@@ -36,14 +42,14 @@ type (
 // which it is called
 func (p *Publish) InitProperties(prop *packets.Properties) {
 	p.Properties = &PublishProperties{
-		PayloadFormat:          prop.PayloadFormat,
-		MessageExpiry:          prop.MessageExpiry,
-		ContentType:            prop.ContentType,
-		ResponseTopic:          prop.ResponseTopic,
-		CorrelationData:        prop.CorrelationData,
-		TopicAlias:             prop.TopicAlias,
-		SubscriptionIdentifier: prop.SubscriptionIdentifier,
-		User:                   prop.User,
+		PayloadFormat:           prop.PayloadFormat,
+		MessageExpiry:           prop.MessageExpiry,
+		ContentType:             prop.ContentType,
+		ResponseTopic:           prop.ResponseTopic,
+		CorrelationData:         prop.CorrelationData,
+		TopicAlias:              prop.TopicAlias,
+		SubscriptionIdentifiers: prop.SubscriptionIdentifiers,
+		User:                    prop.User,
 	}
 }
 
@@ -58,14 +64,14 @@ func (p *Publish) Packet() *packets.Publish {
 	}
 	if p.Properties != nil {
 		v.Properties = &packets.Properties{
-			PayloadFormat:          p.Properties.PayloadFormat,
-			MessageExpiry:          p.Properties.MessageExpiry,
-			ContentType:            p.Properties.ContentType,
-			ResponseTopic:          p.Properties.ResponseTopic,
-			CorrelationData:        p.Properties.CorrelationData,
-			TopicAlias:             p.Properties.TopicAlias,
-			SubscriptionIdentifier: p.Properties.SubscriptionIdentifier,
-			User:                   p.Properties.User,
+			PayloadFormat:           p.Properties.PayloadFormat,
+			MessageExpiry:           p.Properties.MessageExpiry,
+			ContentType:             p.Properties.ContentType,
+			ResponseTopic:           p.Properties.ResponseTopic,
+			CorrelationData:         p.Properties.CorrelationData,
+			TopicAlias:              p.Properties.TopicAlias,
+			SubscriptionIdentifiers: p.Properties.SubscriptionIdentifiers,
+			User:                    p.Properties.User,
 		}
 	}
 
@@ -91,8 +97,8 @@ func (p *Publish) String() string {
 	if p.Properties.CorrelationData != nil {
 		fmt.Fprintf(&b, "CorrelationData: %v\n", p.Properties.CorrelationData)
 	}
-	if p.Properties.SubscriptionIdentifier != nil {
-		fmt.Fprintf(&b, "SubscriptionIdentifier: %v\n", p.Properties.SubscriptionIdentifier)
+	if p.Properties.SubscriptionIdentifiers != nil {
+		fmt.Fprintf(&b, "SubscriptionIdentifiers: %v\n", p.Properties.SubscriptionIdentifiers)
 	}
 	for k, v := range p.Properties.User {
 		fmt.Fprintf(&b, "User: %s : %s\n", k, v)
@@ -1,6 +1,10 @@
 package paho
 
-import "github.com/netdata/paho.golang/packets"
+import (
+	"sort"
+
+	"github.com/netdata/paho.golang/packets"
+)
 
 type (
 	// Subscribe is a representation of a MQTT subscribe packet
@@ -18,6 +22,10 @@ type (
 	}
 )
 
+// MaxSubscriptionIdentifier is the highest Subscription Identifier allowed
+// by the protocol.
+const MaxSubscriptionIdentifier = 268435455
+
 // SubscribeProperties is a struct of the properties that can be set
 // for a Subscribe packet
 type SubscribeProperties struct {
@@ -30,8 +38,10 @@ type SubscribeProperties struct {
 // which it is called
 func (s *Subscribe) InitProperties(prop *packets.Properties) {
 	s.Properties = &SubscribeProperties{
-		SubscriptionIdentifier: prop.SubscriptionIdentifier,
-		User:                   prop.User,
+		User: prop.User,
+	}
+	if len(prop.SubscriptionIdentifiers) > 0 {
+		s.Properties.SubscriptionIdentifier = &prop.SubscriptionIdentifiers[0]
 	}
 }
 
@@ -51,6 +61,17 @@ func (s *Subscribe) PacketSubOptionsFromSubscribeOptions() map[string]packets.Su
 	return r
 }
 
+// Topics returns the topic filters of the Subscribe in the order they are
+// sent to the server, which is the order of the reason codes in the Suback.
+func (s *Subscribe) Topics() []string {
+	topics := make([]string, 0, len(s.Subscriptions))
+	for t := range s.Subscriptions {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
 // Packet returns a packets library Subscribe from the paho Subscribe
 // on which it is called
 func (s *Subscribe) Packet() *packets.Subscribe {
@@ -58,8 +79,10 @@ func (s *Subscribe) Packet() *packets.Subscribe {
 
 	if s.Properties != nil {
 		v.Properties = &packets.Properties{
-			SubscriptionIdentifier: s.Properties.SubscriptionIdentifier,
-			User:                   s.Properties.User,
+			User: s.Properties.User,
+		}
+		if s.Properties.SubscriptionIdentifier != nil {
+			v.Properties.SubscriptionIdentifiers = []uint32{*s.Properties.SubscriptionIdentifier}
 		}
 	}
 
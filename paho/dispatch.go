@@ -0,0 +1,232 @@
+package paho
+
+import (
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+// DispatchMode determines how the Client passes inbound Publishes to the
+// Router. Whatever the mode, the Client keeps reading from the network
+// while QoS1 and QoS2 Publishes are waiting to be routed, the server not
+// sending more than ReceiveMaximum (as sent in the Connect) of them
+// unacknowledged. The reader only waits when QueueSize QoS0 Publishes are
+// already waiting, so that a burst of them cannot grow the queues without
+// limit.
+type DispatchMode int
+
+const (
+	// DispatchConcurrent routes Publishes on up to Workers goroutines,
+	// started as needed, so that their order is not preserved. It is the
+	// default.
+	DispatchConcurrent DispatchMode = iota
+	// DispatchSequential routes Publishes one at a time, in the order they
+	// were received.
+	DispatchSequential
+	// DispatchWorkerPool routes Publishes on a fixed number of goroutines,
+	// set by ClientConfig.Workers, in no particular order.
+	DispatchWorkerPool
+	// DispatchByTopic routes Publishes on a fixed number of goroutines,
+	// set by ClientConfig.Workers, all the Publishes of a topic being
+	// routed by the same goroutine in the order they were received.
+	DispatchByTopic
+)
+
+// dispatcher returns the function passing inbound Publishes to the Router
+// as set by Dispatch, it only blocks on QoS0 Publishes while QueueSize of
+// them are waiting in the queue.
+func (c *Client) dispatcher() func(*packets.Publish, func() error) {
+	route := func(d dispatched) {
+		c.Router.Route(d.pb, d.ack)
+		if c.AckMode == AckAuto {
+			_ = d.ack()
+		}
+	}
+	workers := c.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	size := c.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	newQueue := func() *dispatchQueue {
+		return newDispatchQueue(c.exit, size)
+	}
+
+	switch c.Dispatch {
+	case DispatchSequential:
+		q := newQueue()
+		go q.run(c.exit, route)
+		return q.push
+	case DispatchWorkerPool:
+		q := newQueue()
+		for i := 0; i < workers; i++ {
+			go q.run(c.exit, route)
+		}
+		return q.push
+	case DispatchByTopic:
+		qs := make([]*dispatchQueue, workers)
+		for i := range qs {
+			qs[i] = newQueue()
+			go qs[i].run(c.exit, route)
+		}
+		return func(pb *packets.Publish, ack func() error) {
+			qs[topicHash(pb.Topic)%uint32(len(qs))].push(pb, ack)
+		}
+	default:
+		q := newQueue()
+		sem := semaphore.NewWeighted(int64(workers))
+		return func(pb *packets.Publish, ack func() error) {
+			q.push(pb, ack)
+			if sem.TryAcquire(1) {
+				go q.drain(c.exit, sem, route)
+			}
+		}
+	}
+}
+
+type dispatched struct {
+	pb  *packets.Publish
+	ack func() error
+}
+
+// dispatchQueue is a FIFO of Publishes waiting to be routed, holding at
+// most size QoS0 Publishes. QoS1 and QoS2 Publishes are bounded by the
+// Receive Maximum instead.
+type dispatchQueue struct {
+	mu    sync.Mutex
+	items []dispatched
+	qos0  int
+	size  int
+	ready chan struct{}
+	// space is signalled when a QoS0 Publish leaves the queue, the queue
+	// having a single producer.
+	space chan struct{}
+	exit  <-chan struct{}
+}
+
+func newDispatchQueue(exit <-chan struct{}, size int) *dispatchQueue {
+	return &dispatchQueue{
+		size:  size,
+		ready: make(chan struct{}, 1),
+		space: make(chan struct{}, 1),
+		exit:  exit,
+	}
+}
+
+// push adds a Publish to the queue, waiting for room if it is a QoS0 one
+// and the queue already holds size of them. The Publish is dropped if exit
+// is closed meanwhile.
+func (q *dispatchQueue) push(pb *packets.Publish, ack func() error) {
+	q.mu.Lock()
+	for pb.QoS == 0 && q.qos0 >= q.size {
+		q.mu.Unlock()
+		select {
+		case <-q.space:
+		case <-q.exit:
+			return
+		}
+		q.mu.Lock()
+	}
+	if pb.QoS == 0 {
+		q.qos0++
+	}
+	q.items = append(q.items, dispatched{pb, ack})
+	q.mu.Unlock()
+	q.signal()
+}
+
+// pop removes the first Publish of the queue, ok is false if it is empty
+// and more reports whether others are left.
+func (q *dispatchQueue) pop() (d dispatched, ok, more bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return dispatched{}, false, false
+	}
+	d = q.items[0]
+	q.items[0] = dispatched{}
+	q.items = q.items[1:]
+	if d.pb.QoS == 0 {
+		q.qos0--
+		select {
+		case q.space <- struct{}{}:
+		default:
+		}
+	}
+	return d, true, len(q.items) > 0
+}
+
+func (q *dispatchQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run routes the Publishes of the queue until exit is closed, several
+// goroutines may run the same queue.
+func (q *dispatchQueue) run(exit <-chan struct{}, route func(dispatched)) {
+	for {
+		d, ok, more := q.pop()
+		if !ok {
+			select {
+			case <-q.ready:
+				continue
+			case <-exit:
+				return
+			}
+		}
+		if more {
+			// Wake up another goroutine running the queue, if any.
+			q.signal()
+		}
+
+		select {
+		case <-exit:
+			return
+		default:
+		}
+		route(d)
+	}
+}
+
+// drain routes the Publishes of the queue until it is empty or exit is
+// closed, holding a slot of sem which it releases when it returns.
+func (q *dispatchQueue) drain(exit <-chan struct{}, sem *semaphore.Weighted, route func(dispatched)) {
+	for {
+		d, ok, _ := q.pop()
+		if !ok {
+			sem.Release(1)
+			// A Publish pushed since pop may have found no free slot.
+			q.mu.Lock()
+			empty := len(q.items) == 0
+			q.mu.Unlock()
+			if empty || !sem.TryAcquire(1) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-exit:
+			sem.Release(1)
+			return
+		default:
+		}
+		route(d)
+	}
+}
+
+// topicHash is the 32 bit FNV-1a hash of topic.
+func topicHash(topic string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(topic); i++ {
+		h ^= uint32(topic[i])
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,56 @@
+package paho
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+func TestDispatchQueueBound(t *testing.T) {
+	exit := make(chan struct{})
+	q := newDispatchQueue(exit, 2)
+	for i := 0; i < 2; i++ {
+		q.push(&packets.Publish{Topic: "qos0"}, nil)
+	}
+	// QoS1 and QoS2 Publishes are bounded by the Receive Maximum instead.
+	q.push(&packets.Publish{Topic: "qos1", QoS: 1}, nil)
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(&packets.Publish{Topic: "qos0"}, nil)
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push did not wait for room in the queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d, ok, _ := q.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "qos0", d.pb.Topic)
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push still waiting after a Publish left the queue")
+	}
+
+	// A push waiting for room gives up when the client exits.
+	dropped := make(chan struct{})
+	go func() {
+		q.push(&packets.Publish{Topic: "dropped"}, nil)
+		close(dropped)
+	}()
+	close(exit)
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatal("push still waiting after exit was closed")
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	assert.Len(t, q.items, 3)
+}
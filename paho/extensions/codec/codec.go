@@ -0,0 +1,189 @@
+// Package codec encodes and decodes the payloads of Publishes according
+// to their Content Type, so that handlers deal with values rather than
+// bytes.
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+// The content types of the built in codecs.
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/x-binary"
+	ContentTypeRaw    = "application/octet-stream"
+)
+
+var (
+	// ErrUnknownContentType is returned when no codec is registered for
+	// the content type of a payload.
+	ErrUnknownContentType = errors.New("codec: unknown content type")
+	// ErrInvalidUTF8 is returned when decoding a payload which is not
+	// valid UTF-8 although its Payload Format Indicator says it is.
+	ErrInvalidUTF8 = errors.New("codec: payload is not valid UTF-8")
+)
+
+// Codec encodes values into payloads of a content type and decodes them
+// back.
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Registry holds the codecs used for the content types they handle.
+type Registry struct {
+	mu       sync.RWMutex
+	codecs   map[string]Codec
+	fallback string
+}
+
+// NewRegistry returns a Registry holding codecs, the first of which is
+// also used for the payloads without a content type.
+func NewRegistry(codecs ...Codec) *Registry {
+	r := &Registry{codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		r.Register(c)
+	}
+	if len(codecs) > 0 {
+		r.fallback = codecs[0].ContentType()
+	}
+	return r
+}
+
+// Default is the Registry holding the built in codecs, JSON being used
+// for the payloads without a content type.
+var Default = NewRegistry(JSON, Binary, Raw)
+
+// Register adds c to the Registry, replacing the codec registered for the
+// same content type if any.
+func (r *Registry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[c.ContentType()] = c
+}
+
+// Lookup returns the codec used for contentType.
+func (r *Registry) Lookup(contentType string) (Codec, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if contentType == "" {
+		contentType = r.fallback
+	}
+	c, ok := r.codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// Encode returns the payload of contentType encoding v.
+func (r *Registry) Encode(contentType string, v interface{}) ([]byte, error) {
+	c, err := r.Lookup(contentType)
+	if err != nil {
+		return nil, err
+	}
+	return c.Marshal(v)
+}
+
+// Decode decodes the payload of pb into v with the codec of its content
+// type, after checking that it is valid UTF-8 if its Payload Format
+// Indicator says so.
+func (r *Registry) Decode(pb *paho.Publish, v interface{}) error {
+	var contentType string
+	if pb.Properties != nil {
+		contentType = pb.Properties.ContentType
+		if pb.Properties.PayloadFormat != nil && *pb.Properties.PayloadFormat == 1 && !utf8.Valid(pb.Payload) {
+			return ErrInvalidUTF8
+		}
+	}
+	c, err := r.Lookup(contentType)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(pb.Payload, v)
+}
+
+type jsonCodec struct{}
+
+// JSON encodes values with encoding/json.
+var JSON Codec = jsonCodec{}
+
+func (jsonCodec) ContentType() string                        { return ContentTypeJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type binaryCodec struct{}
+
+// Binary encodes the values implementing encoding.BinaryMarshaler, and
+// decodes into those implementing encoding.BinaryUnmarshaler, with their
+// own methods. Other values must be fixed-size, as understood by
+// encoding/binary, and are encoded in big endian order.
+var Binary Codec = binaryCodec{}
+
+func (binaryCodec) ContentType() string { return ContentTypeBinary }
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		return nil, fmt.Errorf("codec: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, binary.BigEndian, v); err != nil {
+		return fmt.Errorf("codec: %w", err)
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("codec: %d trailing bytes", r.Len())
+	}
+	return nil
+}
+
+type rawCodec struct{}
+
+// Raw passes payloads through as is, it encodes []byte and string values
+// and decodes into *[]byte and *string ones.
+var Raw Codec = rawCodec{}
+
+func (rawCodec) ContentType() string { return ContentTypeRaw }
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("codec: cannot encode %T as raw bytes", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append((*v)[:0], data...)
+	case *string:
+		*v = string(data)
+	default:
+		return fmt.Errorf("codec: cannot decode raw bytes into %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+type point struct {
+	X, Y int32
+}
+
+func TestRegistryRoundTrip(t *testing.T) {
+	tests := []struct {
+		contentType string
+		in          interface{}
+		out         interface{}
+		want        interface{}
+	}{
+		{ContentTypeJSON, point{1, 2}, new(point), &point{1, 2}},
+		{ContentTypeBinary, point{1, 2}, new(point), &point{1, 2}},
+		{ContentTypeBinary, time.Unix(1, 0), new(time.Time), nil},
+		{ContentTypeRaw, []byte("raw"), new([]byte), &[]byte{'r', 'a', 'w'}},
+		{ContentTypeRaw, "raw", new(string), func() *string { s := "raw"; return &s }()},
+	}
+	for _, tt := range tests {
+		payload, err := Default.Encode(tt.contentType, tt.in)
+		require.NoError(t, err, tt.contentType)
+		pb := &paho.Publish{Payload: payload, Properties: &paho.PublishProperties{ContentType: tt.contentType}}
+		require.NoError(t, Default.Decode(pb, tt.out), tt.contentType)
+		if tm, ok := tt.in.(time.Time); ok {
+			// Times implement encoding.BinaryMarshaler.
+			assert.True(t, tm.Equal(*tt.out.(*time.Time)))
+			continue
+		}
+		assert.Equal(t, tt.want, tt.out, tt.contentType)
+	}
+}
+
+func TestRegistryDecode(t *testing.T) {
+	var p point
+	err := Default.Decode(&paho.Publish{Payload: []byte(`{"X":3,"Y":4}`)}, &p)
+	require.NoError(t, err)
+	assert.Equal(t, point{3, 4}, p)
+
+	err = Default.Decode(&paho.Publish{Properties: &paho.PublishProperties{ContentType: "text/csv"}}, &p)
+	assert.True(t, errors.Is(err, ErrUnknownContentType))
+
+	format := byte(1)
+	err = Default.Decode(&paho.Publish{
+		Payload:    []byte{'"', 0xff, '"'},
+		Properties: &paho.PublishProperties{ContentType: ContentTypeRaw, PayloadFormat: &format},
+	}, new([]byte))
+	assert.Equal(t, ErrInvalidUTF8, err)
+
+	err = Default.Decode(&paho.Publish{
+		Payload:    []byte{0, 0, 0, 1, 0},
+		Properties: &paho.PublishProperties{ContentType: ContentTypeBinary},
+	}, new(int32))
+	assert.EqualError(t, err, "codec: 1 trailing bytes")
+}
+
+func TestPublisherEncode(t *testing.T) {
+	p := &Publisher{QoS: 1}
+	pb, err := p.Encode("points", point{5, 6})
+	require.NoError(t, err)
+	assert.Equal(t, "points", pb.Topic)
+	assert.Equal(t, byte(1), pb.QoS)
+	assert.Equal(t, ContentTypeJSON, pb.Properties.ContentType)
+	assert.Equal(t, `{"X":5,"Y":6}`, string(pb.Payload))
+
+	p.ContentType = ContentTypeRaw
+	_, err = p.Encode("points", point{5, 6})
+	assert.EqualError(t, err, "codec: cannot encode codec.point as raw bytes")
+}
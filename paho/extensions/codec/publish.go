@@ -0,0 +1,55 @@
+package codec
+
+import (
+	"context"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+// Publisher publishes values, encoded with the codec of its content type,
+// through a client.
+type Publisher struct {
+	Conn *paho.Client
+	// ContentType is the content type of the payloads, it defaults to
+	// ContentTypeJSON.
+	ContentType string
+	// Registry holds the codec of ContentType, it defaults to Default.
+	Registry *Registry
+	QoS      byte
+	Retain   bool
+}
+
+// PublishValue publishes v, encoded with the codec of the content type of
+// the Publisher, to topic. The Content Type property is set accordingly.
+func (p *Publisher) PublishValue(ctx context.Context, topic string, v interface{}) (*paho.PublishResponse, error) {
+	pb, err := p.Encode(topic, v)
+	if err != nil {
+		return nil, err
+	}
+	return p.Conn.Publish(ctx, pb)
+}
+
+// Encode returns the Publish that PublishValue sends, so that its other
+// properties can be set before it is published.
+func (p *Publisher) Encode(topic string, v interface{}) (*paho.Publish, error) {
+	r := p.Registry
+	if r == nil {
+		r = Default
+	}
+	contentType := p.ContentType
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	payload, err := r.Encode(contentType, v)
+	if err != nil {
+		return nil, err
+	}
+	return &paho.Publish{
+		QoS:        p.QoS,
+		Retain:     p.Retain,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: &paho.PublishProperties{ContentType: contentType},
+	}, nil
+}
@@ -0,0 +1,66 @@
+package codec
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+)
+
+// ValueHandler is a type for a function that is invoked by a Router with
+// a received Publish and the value decoded from its payload.
+type ValueHandler func(pb *paho.Publish, v interface{}, ack func() error)
+
+// Router is an adapter of an rpc.Router, to which it passes on the
+// Publishes it receives, with which ValueHandlers can be registered.
+type Router struct {
+	rpc.Router
+	// Registry holds the codecs used to decode the payloads, it defaults
+	// to Default.
+	Registry *Registry
+	// OnError, if set, is called with the Publishes whose payload could
+	// not be decoded, which are then acknowledged and dropped.
+	OnError func(pb *paho.Publish, err error)
+}
+
+// NewRouter returns a Router passing Publishes on to r.
+func NewRouter(r rpc.Router) *Router {
+	return &Router{Router: r}
+}
+
+// RegisterValueHandler registers h for topic, the payload of the
+// Publishes being decoded into a new value of the type of proto, which h
+// is passed a pointer to. proto may be either a value or a pointer to
+// one, h receives a *T in both cases. An error is returned, and nothing
+// registered, if proto is nil.
+func (r *Router) RegisterValueHandler(topic string, proto interface{}, h ValueHandler) error {
+	t := reflect.TypeOf(proto)
+	if t == nil {
+		return fmt.Errorf("codec: nil prototype for topic %q", topic)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.RegisterHandler(topic, func(pb *paho.Publish, ack func() error) {
+		v := reflect.New(t).Interface()
+		if err := r.registry().Decode(pb, v); err != nil {
+			if r.OnError != nil {
+				r.OnError(pb, err)
+			}
+			if ack != nil {
+				_ = ack()
+			}
+			return
+		}
+		h(pb, v, ack)
+	})
+	return nil
+}
+
+func (r *Router) registry() *Registry {
+	if r.Registry == nil {
+		return Default
+	}
+	return r.Registry
+}
@@ -0,0 +1,52 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+)
+
+func TestRouter(t *testing.T) {
+	var errs []error
+	r := NewRouter(rpc.NewStandardRouter())
+	r.OnError = func(_ *paho.Publish, err error) {
+		errs = append(errs, err)
+	}
+	var got []*point
+	for _, proto := range []interface{}{point{}, &point{}} {
+		err := r.RegisterValueHandler("points", proto, func(_ *paho.Publish, v interface{}, _ func() error) {
+			got = append(got, v.(*point))
+		})
+		require.NoError(t, err)
+	}
+	// A typed nil pointer still carries the type to decode into.
+	require.NoError(t, r.RegisterValueHandler("typed", (*point)(nil), func(*paho.Publish, interface{}, func() error) {}))
+	assert.Error(t, r.RegisterValueHandler("untyped", nil, func(*paho.Publish, interface{}, func() error) {}))
+
+	var acks int
+	ack := func() error {
+		acks++
+		return nil
+	}
+	r.Route(&packets.Publish{
+		Topic:      "points",
+		Payload:    []byte(`{"X":1,"Y":2}`),
+		Properties: &packets.Properties{ContentType: ContentTypeJSON},
+	}, ack)
+	assert.Equal(t, []*point{{1, 2}, {1, 2}}, got)
+	assert.Equal(t, 0, acks)
+
+	r.Route(&packets.Publish{
+		Topic:      "points",
+		Payload:    []byte(`{`),
+		Properties: &packets.Properties{ContentType: ContentTypeJSON},
+	}, ack)
+	require.Len(t, errs, 2)
+	assert.Equal(t, 2, acks)
+	assert.Len(t, got, 2)
+}
@@ -0,0 +1,143 @@
+// Package middleware provides wrappers adding common behaviour, such as
+// panic recovery or concurrency limits, to any paho.Router.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// Middleware wraps a Router, returning a Router which usually does some
+// work before or after passing the Publishes it receives on to the
+// wrapped one.
+type Middleware func(paho.Router) paho.Router
+
+// Chain wraps r with the given middlewares, the first of which is the
+// outermost and so sees the Publishes first.
+func Chain(r paho.Router, mws ...Middleware) paho.Router {
+	for i := len(mws) - 1; i >= 0; i-- {
+		r = mws[i](r)
+	}
+	return r
+}
+
+// Recover recovers from panics in the wrapped Router, logging them with
+// logger if it is not nil. The Publish is then acknowledged so that the
+// client does not wait for an acknowledgement that will never come.
+func Recover(logger func(context.Context, paho.LogEntry)) Middleware {
+	return func(next paho.Router) paho.Router {
+		return paho.RouterFunc(func(pb *packets.Publish, ack func() error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				if logger != nil {
+					logger(context.Background(), paho.LogEntry{
+						Level:   paho.LevelError,
+						Message: fmt.Sprintf("panic routing Publish on %s", pb.Topic),
+						Error:   fmt.Errorf("%v", r),
+					})
+				}
+				if ack != nil {
+					_ = ack()
+				}
+			}()
+			next.Route(pb, ack)
+		})
+	}
+}
+
+// Timing calls observe with the time taken by the wrapped Router to route
+// every Publish.
+func Timing(observe func(pb *packets.Publish, d time.Duration)) Middleware {
+	return func(next paho.Router) paho.Router {
+		return paho.RouterFunc(func(pb *packets.Publish, ack func() error) {
+			start := time.Now()
+			next.Route(pb, ack)
+			observe(pb, time.Since(start))
+		})
+	}
+}
+
+// ExpiryFilter acknowledges and drops the Publishes whose Message Expiry
+// Interval has elapsed, instead of passing them on to the wrapped Router.
+// The interval is counted from the time the client received the Publish,
+// see packets.Publish.ReceivedAt, so that the time it spent waiting in
+// the dispatch queues of the client or in middlewares such as
+// TopicConcurrency is accounted for.
+func ExpiryFilter() Middleware {
+	return func(next paho.Router) paho.Router {
+		return paho.RouterFunc(func(pb *packets.Publish, ack func() error) {
+			if pb.Properties != nil && pb.Properties.MessageExpiry != nil && !pb.ReceivedAt.IsZero() {
+				expiry := time.Duration(*pb.Properties.MessageExpiry) * time.Second
+				if time.Since(pb.ReceivedAt) >= expiry {
+					if ack != nil {
+						_ = ack()
+					}
+					return
+				}
+			}
+			next.Route(pb, ack)
+		})
+	}
+}
+
+// TopicConcurrency limits the number of Publishes for the same topic the
+// wrapped Router routes at once to n, Route blocks until the Publish can
+// be passed on. n is raised to 1 if lower.
+func TopicConcurrency(n int) Middleware {
+	if n < 1 {
+		n = 1
+	}
+	return func(next paho.Router) paho.Router {
+		return &topicConcurrency{
+			next:  next,
+			limit: n,
+			slots: make(map[string]*topicSlots),
+		}
+	}
+}
+
+type topicConcurrency struct {
+	next  paho.Router
+	limit int
+
+	mu    sync.Mutex
+	slots map[string]*topicSlots
+}
+
+// topicSlots are the slots of a topic, refs counts the Publishes using or
+// waiting for one of them.
+type topicSlots struct {
+	ch   chan struct{}
+	refs int
+}
+
+func (t *topicConcurrency) Route(pb *packets.Publish, ack func() error) {
+	t.mu.Lock()
+	s := t.slots[pb.Topic]
+	if s == nil {
+		s = &topicSlots{ch: make(chan struct{}, t.limit)}
+		t.slots[pb.Topic] = s
+	}
+	s.refs++
+	t.mu.Unlock()
+
+	s.ch <- struct{}{}
+	defer func() {
+		<-s.ch
+		t.mu.Lock()
+		if s.refs--; s.refs == 0 {
+			delete(t.slots, pb.Topic)
+		}
+		t.mu.Unlock()
+	}()
+
+	t.next.Route(pb, ack)
+}
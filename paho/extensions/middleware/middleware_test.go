@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+	"github.com/netdata/paho.golang/paho/extensions/rpc"
+)
+
+func publish(topic string) *packets.Publish {
+	return &packets.Publish{Topic: topic, QoS: 1, Properties: &packets.Properties{}}
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next paho.Router) paho.Router {
+			return paho.RouterFunc(func(pb *packets.Publish, ack func() error) {
+				order = append(order, name)
+				next.Route(pb, ack)
+			})
+		}
+	}
+	r := Chain(paho.RouterFunc(func(*packets.Publish, func() error) {
+		order = append(order, "router")
+	}), mw("first"), mw("second"))
+
+	r.Route(publish("a"), nil)
+	assert.Equal(t, []string{"first", "second", "router"}, order)
+}
+
+func TestRecover(t *testing.T) {
+	var logged []paho.LogEntry
+	var acks int
+	router := rpc.NewStandardRouter()
+	router.RegisterHandler("a", func(*paho.Publish, func() error) {
+		panic("boom")
+	})
+	r := Chain(router, Recover(func(_ context.Context, e paho.LogEntry) {
+		logged = append(logged, e)
+	}))
+
+	r.Route(publish("a"), func() error {
+		acks++
+		return nil
+	})
+	assert.Equal(t, 1, acks)
+	require.Len(t, logged, 1)
+	assert.Equal(t, paho.LevelError, logged[0].Level)
+	assert.EqualError(t, logged[0].Error, "boom")
+}
+
+func TestTiming(t *testing.T) {
+	var observed time.Duration
+	r := Chain(paho.RouterFunc(func(*packets.Publish, func() error) {
+		time.Sleep(10 * time.Millisecond)
+	}), Timing(func(_ *packets.Publish, d time.Duration) {
+		observed = d
+	}))
+
+	r.Route(publish("a"), nil)
+	assert.True(t, observed >= 10*time.Millisecond)
+}
+
+func TestExpiryFilter(t *testing.T) {
+	var routed []string
+	r := Chain(paho.RouterFunc(func(pb *packets.Publish, _ func() error) {
+		routed = append(routed, string(pb.Payload))
+	}), ExpiryFilter())
+
+	expiry := uint32(1)
+	received := map[string]time.Time{
+		"expired": time.Now().Add(-2 * time.Second),
+		"fresh":   time.Now(),
+		// Publishes which were not received by a client are never dropped.
+		"unknown": {},
+	}
+	acked := 0
+	for _, payload := range []string{"expired", "fresh", "unknown"} {
+		r.Route(&packets.Publish{
+			Topic:      "a",
+			Payload:    []byte(payload),
+			Properties: &packets.Properties{MessageExpiry: &expiry},
+			ReceivedAt: received[payload],
+		}, func() error {
+			acked++
+			return nil
+		})
+	}
+	r.Route(&packets.Publish{
+		Topic:      "a",
+		Payload:    []byte("no expiry"),
+		Properties: &packets.Properties{},
+		ReceivedAt: time.Now().Add(-time.Hour),
+	}, nil)
+
+	assert.Equal(t, 1, acked)
+	assert.Equal(t, []string{"fresh", "unknown", "no expiry"}, routed)
+}
+
+func TestTopicConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running := make(map[string]int)
+	max := make(map[string]int)
+	r := Chain(paho.RouterFunc(func(pb *packets.Publish, _ func() error) {
+		mu.Lock()
+		running[pb.Topic]++
+		if running[pb.Topic] > max[pb.Topic] {
+			max[pb.Topic] = running[pb.Topic]
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running[pb.Topic]--
+		mu.Unlock()
+	}), TopicConcurrency(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, topic := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(topic string) {
+				defer wg.Done()
+				r.Route(publish(topic), nil)
+			}(topic)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, max)
+	assert.Empty(t, r.(*topicConcurrency).slots)
+}
@@ -10,7 +10,7 @@ import (
 
 // MessageHandler is a type for a function that is invoked
 // by a Router when it has received a Publish.
-type MessageHandler func(*paho.Publish, func() error)
+type MessageHandler = func(*paho.Publish, func() error)
 
 // Router is an interface of the functions for a struct that is
 // used to handle invoking MessageHandlers depending on the
@@ -33,14 +33,12 @@ type Router interface {
 type StandardRouter struct {
 	sync.RWMutex
 	subscriptions map[string][]MessageHandler
-	aliases       map[uint16]string
 }
 
 // NewStandardRouter instantiates and returns an instance of a StandardRouter
 func NewStandardRouter() *StandardRouter {
 	return &StandardRouter{
 		subscriptions: make(map[string][]MessageHandler),
-		aliases:       make(map[uint16]string),
 	}
 }
 
@@ -68,21 +66,8 @@ func (r *StandardRouter) Route(pb *packets.Publish, ack func() error) {
 
 	m := PublishFromPacketPublish(pb)
 
-	var topic string
-	if pb.Properties.TopicAlias != nil {
-		if pb.Topic != "" {
-			//Register new alias
-			r.aliases[*pb.Properties.TopicAlias] = pb.Topic
-		}
-		if t, ok := r.aliases[*pb.Properties.TopicAlias]; ok {
-			topic = t
-		}
-	} else {
-		topic = m.Topic
-	}
-
 	for route, handlers := range r.subscriptions {
-		if match(route, topic) {
+		if match(route, m.Topic) {
 			for _, handler := range handlers {
 				handler(m, ack)
 			}
@@ -142,14 +127,12 @@ func topicSplit(topic string) []string {
 // for all received Publishes
 type SingleHandlerRouter struct {
 	sync.Mutex
-	aliases map[uint16]string
 	handler MessageHandler
 }
 
 // NewSingleHandlerRouter instantiates and returns an instance of a SingleHandlerRouter
 func NewSingleHandlerRouter(h MessageHandler) *SingleHandlerRouter {
 	return &SingleHandlerRouter{
-		aliases: make(map[uint16]string),
 		handler: h,
 	}
 }
@@ -167,28 +150,18 @@ func (s *SingleHandlerRouter) UnregisterHandler(topic string) {}
 // Route is the library provided SingleHandlerRouter's
 // implementation of the required interface function()
 func (s *SingleHandlerRouter) Route(pb *packets.Publish, ack func() error) {
-	m := PublishFromPacketPublish(pb)
-
-	if pb.Properties.TopicAlias != nil {
-		if pb.Topic != "" {
-			//Register new alias
-			s.aliases[*pb.Properties.TopicAlias] = pb.Topic
-		}
-		if t, ok := s.aliases[*pb.Properties.TopicAlias]; ok {
-			m.Topic = t
-		}
-	}
-	s.handler(m, ack)
+	s.handler(PublishFromPacketPublish(pb), ack)
 }
 
 // PublishFromPacketPublish takes a packets library Publish and
 // returns a paho library Publish
 func PublishFromPacketPublish(p *packets.Publish) *paho.Publish {
 	v := &paho.Publish{
-		QoS:     p.QoS,
-		Retain:  p.Retain,
-		Topic:   p.Topic,
-		Payload: p.Payload,
+		QoS:        p.QoS,
+		Retain:     p.Retain,
+		Topic:      p.Topic,
+		Payload:    p.Payload,
+		ReceivedAt: p.ReceivedAt,
 	}
 	v.InitProperties(p.Properties)
 
@@ -2,91 +2,309 @@ package rpc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/netdata/paho.golang/paho"
 )
 
+// ErrClosed is returned by Request once the Handler has been closed.
+var ErrClosed = errors.New("rpc: handler closed")
+
+// The user properties of a response carrying the error a responder
+// failed to handle the request with, see Error.
+const (
+	ErrorProperty     = "rpc-error"
+	ErrorCodeProperty = "rpc-error-code"
+)
+
+// Error is the error carried by a response in its user properties,
+// Request returns it along with the response.
+type Error struct {
+	// Code is an optional application defined code identifying the error.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("rpc: %s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("rpc: %s", e.Message)
+}
+
+// Properties returns the user properties carrying e, to be set on the
+// response to a request.
+func (e *Error) Properties() map[string]string {
+	user := map[string]string{ErrorProperty: e.Message}
+	if e.Code != "" {
+		user[ErrorCodeProperty] = e.Code
+	}
+	return user
+}
+
+// ResponseError returns the Error carried by the response pb, if any.
+func ResponseError(pb *paho.Publish) error {
+	if pb.Properties == nil {
+		return nil
+	}
+	msg, ok := pb.Properties.User[ErrorProperty]
+	if !ok {
+		return nil
+	}
+	return &Error{Code: pb.Properties.User[ErrorCodeProperty], Message: msg}
+}
+
+// DefaultResponseTopicFmt is the format of the response topic of a
+// Handler when HandlerOpts.ResponseTopicFmt is not set.
+const DefaultResponseTopicFmt = "%s/responses"
+
+// HandlerOpts are the options of a Handler, Conn is required.
+type HandlerOpts struct {
+	// Conn is the connected client the requests are published through.
+	Conn *paho.Client
+	// Router is the Router of Conn, it defaults to Conn.Router which must
+	// then implement Router.
+	Router Router
+	// ResponseTopicFmt is the format of the response topic, in which %s
+	// is replaced by the client identifier. When the server sent Response
+	// Information in its Connack, see RequestResponseInfo, the response
+	// topic is placed under it.
+	ResponseTopicFmt string
+	// ClientID is the client identifier used in the response topic, it
+	// defaults to Conn.ClientID(), which is the one assigned by the
+	// server to clients connecting without one.
+	ClientID string
+}
+
+// RequestResponseInfo sets the Request Response Information property of
+// cp, so that the server sends the prefix of the topics the client may use
+// for responses in its Connack, where NewHandler picks it up.
+func RequestResponseInfo(cp *paho.Connect) {
+	if cp.Properties == nil {
+		cp.Properties = &paho.ConnectProperties{}
+	}
+	cp.Properties.RequestResponseInfo = true
+}
+
+// responseTopic returns the response topic of a Handler with the given
+// options.
+func responseTopic(opts HandlerOpts) (string, error) {
+	clientID := opts.ClientID
+	if clientID == "" {
+		clientID = opts.Conn.ClientID()
+	}
+	if clientID == "" {
+		return "", fmt.Errorf("rpc: a client identifier is required")
+	}
+	format := opts.ResponseTopicFmt
+	if format == "" {
+		format = DefaultResponseTopicFmt
+	}
+
+	topic := fmt.Sprintf(format, clientID)
+	if ca := opts.Conn.Connack(); ca != nil && ca.Properties != nil && ca.Properties.ResponseInfo != "" {
+		topic = strings.TrimSuffix(ca.Properties.ResponseInfo, "/") + "/" + topic
+	}
+	return topic, nil
+}
+
 // Handler is the struct providing a request/response functionality for the paho
 // MQTT v5 client
 type Handler struct {
 	sync.Mutex
-	c          *paho.Client
-	clientID   string
-	correlData map[string]chan *paho.Publish
+	c             *paho.Client
+	router        Router
+	responseTopic string
+	correlData    map[string]*call
+	closed        bool
+	done          chan struct{} // closed by Close.
+}
+
+// call is a request waiting for its responses.
+type call struct {
+	responses chan *paho.Publish
+	// done is closed once the requester stopped waiting for responses.
+	done chan struct{}
 }
 
-func NewHandler(config paho.ClientConfig, clientID string) (*Handler, error) {
-	r, ok := config.Router.(Router)
-	if !ok && config.Router != nil {
-		return nil, fmt.Errorf("config.Router must be nil or implement rpc.Router")
+// NewHandler registers the handler of the responses with the Router of
+// opts.Conn and subscribes to the response topic, the returned Handler
+// is then ready to send requests.
+func NewHandler(ctx context.Context, opts HandlerOpts) (*Handler, error) {
+	if opts.Conn == nil {
+		return nil, fmt.Errorf("rpc: a connected client is required")
+	}
+	topic, err := responseTopic(opts)
+	if err != nil {
+		return nil, err
 	}
+	r := opts.Router
 	if r == nil {
-		r = NewStandardRouter()
-		config.Router = r
+		var ok bool
+		if r, ok = opts.Conn.Router.(Router); !ok {
+			return nil, fmt.Errorf("rpc: the Router of the client must implement rpc.Router, not %T", opts.Conn.Router)
+		}
 	}
 
-	c := paho.NewClient(config)
 	h := &Handler{
-		c:          c,
-		correlData: make(map[string]chan *paho.Publish),
-		clientID:   clientID,
+		c:             opts.Conn,
+		router:        r,
+		responseTopic: topic,
+		correlData:    make(map[string]*call),
+		done:          make(chan struct{}),
 	}
 
-	r.RegisterHandler(fmt.Sprintf("%s/responses", clientID), h.responseHandler)
+	r.RegisterHandler(h.responseTopic, h.responseHandler)
 
-	_, err := c.Subscribe(context.Background(), &paho.Subscribe{
+	_, err = h.c.Subscribe(ctx, &paho.Subscribe{
 		Subscriptions: map[string]paho.SubscribeOptions{
-			fmt.Sprintf("%s/responses", clientID): paho.SubscribeOptions{QoS: 1},
+			h.responseTopic: {QoS: 1},
 		},
 	})
 	if err != nil {
+		r.UnregisterHandler(h.responseTopic)
 		return nil, err
 	}
 
 	return h, nil
 }
 
-func (h *Handler) addCorrelID(cID string, r chan *paho.Publish) {
+// ResponseTopic returns the topic the responses to the requests of h are
+// sent to.
+func (h *Handler) ResponseTopic() string {
+	return h.responseTopic
+}
+
+func (h *Handler) addCorrelID(cID string, c *call) error {
 	h.Lock()
 	defer h.Unlock()
 
-	h.correlData[cID] = r
+	if h.closed {
+		return ErrClosed
+	}
+	h.correlData[cID] = c
+	return nil
 }
 
-func (h *Handler) getCorrelIDChan(cID string) chan *paho.Publish {
+func (h *Handler) getCorrelIDCall(cID string) *call {
 	h.Lock()
 	defer h.Unlock()
 
-	rChan := h.correlData[cID]
-	delete(h.correlData, cID)
-
-	return rChan
+	return h.correlData[cID]
 }
 
-func (h *Handler) Request(pb *paho.Publish) (*paho.Publish, error) {
-	cID := fmt.Sprintf("%d", time.Now().UnixNano())
-	rChan := make(chan *paho.Publish)
-
-	h.addCorrelID(cID, rChan)
+// removeCorrelID stops the responses with correlation data cID from
+// being waited for.
+func (h *Handler) removeCorrelID(cID string) {
+	h.Lock()
+	defer h.Unlock()
 
-	if pb.Properties == nil {
-		pb.Properties = &paho.PublishProperties{}
+	if c, ok := h.correlData[cID]; ok {
+		close(c.done)
+		delete(h.correlData, cID)
 	}
+}
 
-	pb.Properties.CorrelationData = []byte(cID)
-	pb.Properties.ResponseTopic = fmt.Sprintf("%s/responses", h.clientID)
-	pb.Retain = false
+// newCorrelID returns a random correlation identifier, so that
+// concurrent requests, even from different processes, never share one.
+func newCorrelID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rpc: generating correlation data: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
 
-	_, err := h.c.Publish(context.Background(), pb)
+// Request publishes pb, with its Correlation Data and Response Topic set,
+// and waits for the response until ctx is done. pb is not modified. If
+// the response carries an Error, it is returned along with the response.
+func (h *Handler) Request(ctx context.Context, pb *paho.Publish) (*paho.Publish, error) {
+	cID, c, err := h.send(ctx, pb)
 	if err != nil {
 		return nil, err
 	}
+	defer h.removeCorrelID(cID)
 
-	resp := <-rChan
-	return resp, nil
+	select {
+	case resp := <-c.responses:
+		return resp, ResponseError(resp)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-h.done:
+		return nil, ErrClosed
+	}
+}
+
+// send publishes pb as a request and returns the call its responses are
+// received on, which the caller must remove once done with it.
+func (h *Handler) send(ctx context.Context, pb *paho.Publish) (string, *call, error) {
+	cID, err := newCorrelID()
+	if err != nil {
+		return "", nil, err
+	}
+	c := &call{
+		responses: make(chan *paho.Publish),
+		done:      make(chan struct{}),
+	}
+	if err := h.addCorrelID(cID, c); err != nil {
+		return "", nil, err
+	}
+
+	req := *pb
+	var props paho.PublishProperties
+	if pb.Properties != nil {
+		props = *pb.Properties
+	}
+	props.CorrelationData = []byte(cID)
+	props.ResponseTopic = h.responseTopic
+	req.Properties = &props
+	req.Retain = false
+
+	if _, err := h.c.Publish(ctx, &req); err != nil {
+		h.removeCorrelID(cID)
+		return "", nil, err
+	}
+	return cID, c, nil
+}
+
+// Call sends a request with the given payload calling method on the
+// Servers receiving the requests published to topic, see Request.
+func (h *Handler) Call(ctx context.Context, topic, method string, payload []byte) (*paho.Publish, error) {
+	return h.Request(ctx, &paho.Publish{
+		Topic:   topic,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			User: map[string]string{MethodProperty: method},
+		},
+	})
+}
+
+// Close fails the pending requests with ErrClosed and unsubscribes from
+// the response topic. The handler of the responses is unregistered once
+// the subscription is gone; until then it acknowledges, and drops, the
+// responses still arriving, so that they do not count against the Receive
+// Maximum forever. It stays registered if the Unsubscribe fails, its error
+// being returned.
+func (h *Handler) Close(ctx context.Context) error {
+	h.Lock()
+	if h.closed {
+		h.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.done)
+	h.Unlock()
+
+	if _, err := h.c.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{h.responseTopic}}); err != nil {
+		return err
+	}
+	h.router.UnregisterHandler(h.responseTopic)
+	return nil
 }
 
 func (h *Handler) responseHandler(pb *paho.Publish, ack func() error) {
@@ -95,10 +313,15 @@ func (h *Handler) responseHandler(pb *paho.Publish, ack func() error) {
 		return
 	}
 
-	rChan := h.getCorrelIDChan(string(pb.Properties.CorrelationData))
-	if rChan == nil {
+	c := h.getCorrelIDCall(string(pb.Properties.CorrelationData))
+	if c == nil {
 		return
 	}
 
-	rChan <- pb
+	// Responses arriving once the requester stopped waiting are dropped.
+	select {
+	case c.responses <- pb:
+	case <-c.done:
+	case <-h.done:
+	}
 }
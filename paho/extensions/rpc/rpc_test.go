@@ -0,0 +1,205 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// responder serves a single client connection, answering the requests
+// published to "echo" with their payload, those published to "fail" with
+// an Error and leaving the others unanswered, and accepting every
+// Unsubscribe. Clients connecting without a client identifier are
+// assigned "assigned", and those requesting it are sent the "rpc/"
+// Response Information.
+func responder(conn net.Conn) {
+	defer conn.Close()
+	for {
+		recv, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var resp io.WriterTo
+		switch recv.Type {
+		case packets.CONNECT:
+			cp := recv.Content.(*packets.Connect)
+			ca := &packets.Connack{Properties: &packets.Properties{}}
+			if cp.ClientID == "" {
+				ca.Properties.AssignedClientID = "assigned"
+			}
+			if cp.Properties.RequestResponseInfo != nil && *cp.Properties.RequestResponseInfo == 1 {
+				ca.Properties.ResponseInfo = "rpc/"
+			}
+			resp = ca
+		case packets.SUBSCRIBE:
+			s := recv.Content.(*packets.Subscribe)
+			resp = &packets.Suback{PacketID: s.PacketID, Reasons: make([]byte, len(s.Subscriptions)), Properties: &packets.Properties{}}
+		case packets.UNSUBSCRIBE:
+			u := recv.Content.(*packets.Unsubscribe)
+			resp = &packets.Unsuback{PacketID: u.PacketID, Reasons: make([]byte, len(u.Topics)), Properties: &packets.Properties{}}
+		case packets.PUBLISH:
+			p := recv.Content.(*packets.Publish)
+			if p.QoS > 0 {
+				pa := packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+				if _, err := pa.WriteTo(conn); err != nil {
+					return
+				}
+			}
+			if p.Topic != "echo" && p.Topic != "fail" {
+				continue
+			}
+			r := &packets.Publish{
+				Topic:   p.Properties.ResponseTopic,
+				Payload: p.Payload,
+				Properties: &packets.Properties{
+					CorrelationData: p.Properties.CorrelationData,
+				},
+			}
+			if p.Topic == "fail" {
+				r.Properties.User = (&Error{Code: "E42", Message: "failed"}).Properties()
+			}
+			resp = r
+		default:
+			continue
+		}
+		if _, err := resp.WriteTo(conn); err != nil {
+			return
+		}
+	}
+}
+
+func newTestClient(t *testing.T, cp *paho.Connect) *paho.Client {
+	server, conn := net.Pipe()
+	go responder(server)
+
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:   conn,
+		Router: NewStandardRouter(),
+	})
+	_, err := c.Connect(context.Background(), cp)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Disconnect(context.Background(), &paho.Disconnect{})
+	})
+	return c
+}
+
+func newTestHandler(t *testing.T) *Handler {
+	c := newTestClient(t, &paho.Connect{ClientID: "test"})
+	h, err := NewHandler(context.Background(), HandlerOpts{Conn: c})
+	require.NoError(t, err)
+	return h
+}
+
+func TestHandlerResponseTopic(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientID     string
+		responseInfo bool
+		opts         HandlerOpts
+		want         string
+	}{
+		{name: "default", clientID: "test", want: "test/responses"},
+		{name: "assigned", want: "assigned/responses"},
+		{name: "clientID", clientID: "test", opts: HandlerOpts{ClientID: "other"}, want: "other/responses"},
+		{name: "fmt", clientID: "test", opts: HandlerOpts{ResponseTopicFmt: "replies/%s"}, want: "replies/test"},
+		{name: "responseInfo", clientID: "test", responseInfo: true, want: "rpc/test/responses"},
+		{name: "responseInfoFmt", responseInfo: true, opts: HandlerOpts{ResponseTopicFmt: "%s"}, want: "rpc/assigned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := &paho.Connect{ClientID: tt.clientID}
+			if tt.responseInfo {
+				RequestResponseInfo(cp)
+			}
+			tt.opts.Conn = newTestClient(t, cp)
+			h, err := NewHandler(context.Background(), tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, h.ResponseTopic())
+
+			resp, err := h.Request(context.Background(), &paho.Publish{Topic: "echo", Payload: []byte("hi")})
+			require.NoError(t, err)
+			assert.Equal(t, "hi", string(resp.Payload))
+		})
+	}
+}
+
+func TestHandlerRequest(t *testing.T) {
+	h := newTestHandler(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payload := []byte{byte(i)}
+			resp, err := h.Request(context.Background(), &paho.Publish{Topic: "echo", Payload: payload})
+			require.NoError(t, err)
+			assert.Equal(t, payload, resp.Payload)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestHandlerRequestError(t *testing.T) {
+	h := newTestHandler(t)
+
+	resp, err := h.Request(context.Background(), &paho.Publish{Topic: "fail"})
+	require.NotNil(t, resp)
+	var rerr *Error
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, &Error{Code: "E42", Message: "failed"}, rerr)
+	assert.EqualError(t, err, "rpc: E42: failed")
+}
+
+func TestHandlerRequestTimeout(t *testing.T) {
+	h := newTestHandler(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := h.Request(ctx, &paho.Publish{Topic: "ignored"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	h.Lock()
+	defer h.Unlock()
+	assert.Empty(t, h.correlData)
+}
+
+func TestHandlerClose(t *testing.T) {
+	h := newTestHandler(t)
+
+	errs := make(chan error)
+	go func() {
+		_, err := h.Request(context.Background(), &paho.Publish{Topic: "ignored"})
+		errs <- err
+	}()
+	// Wait for the request to be pending.
+	for {
+		h.Lock()
+		n := len(h.correlData)
+		h.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, ErrClosed, <-errs)
+	r := h.router.(*StandardRouter)
+	r.RLock()
+	assert.NotContains(t, r.subscriptions, h.responseTopic)
+	r.RUnlock()
+	_, err := h.Request(context.Background(), &paho.Publish{Topic: "echo"})
+	assert.Equal(t, ErrClosed, err)
+}
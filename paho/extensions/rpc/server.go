@@ -0,0 +1,291 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+// MethodProperty is the user property of a request naming the method it
+// calls, Servers dispatch requests by it.
+const MethodProperty = "rpc-method"
+
+// The codes of the Errors a Server replies with when the method handler
+// could not produce a response of its own.
+const (
+	CodeUnknownMethod    = "unknown_method"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeCanceled         = "canceled"
+	CodeInternal         = "internal"
+)
+
+// Request is a request received by a Server.
+type Request struct {
+	Method      string
+	Payload     []byte
+	ContentType string
+	User        map[string]string
+	// Publish is the Publish the request was received in.
+	Publish *paho.Publish
+
+	s *Server
+	// seq is the number of responses sent so far.
+	seq uint64
+}
+
+// Send publishes resp to the requester ahead of the Response returned by
+// the HandlerFunc, which remains the last one, for requests sent with
+// Handler.Stream.
+func (r *Request) Send(ctx context.Context, resp *Response) error {
+	if r.Publish.Properties == nil || r.Publish.Properties.ResponseTopic == "" {
+		return fmt.Errorf("rpc: the request has no response topic")
+	}
+	_, err := r.s.c.Publish(ctx, r.s.response(r, resp, nil, false))
+	return err
+}
+
+// Response is the response to a Request, as returned by a HandlerFunc.
+type Response struct {
+	Payload     []byte
+	ContentType string
+	User        map[string]string
+}
+
+// HandlerFunc handles the requests calling a method. ctx is done when
+// the Message Expiry Interval of the request elapses or when the Server
+// is stopped. An error is sent to the requester in place of the
+// Response, as is if it is an *Error and as a CodeInternal Error
+// otherwise.
+type HandlerFunc func(ctx context.Context, req *Request) (*Response, error)
+
+// ServerOpts are the options of a Server, Conn and Topic are required.
+type ServerOpts struct {
+	// Conn is the connected client requests are received through.
+	Conn *paho.Client
+	// Router is the Router of Conn, it defaults to Conn.Router which must
+	// then implement Router.
+	Router Router
+	// Topic is the topic the requests are published to.
+	Topic string
+	// Group, if set, makes the Server subscribe to Topic as a member of
+	// the shared subscription group of this name, so that requests are
+	// balanced between the Servers of the group.
+	Group string
+	// QoS is the QoS the Server subscribes with and replies at.
+	QoS byte
+}
+
+// Server is the responding side of the request/response functionality,
+// it calls the HandlerFunc registered for the method of every request it
+// receives and publishes the result to the Response Topic of the request.
+type Server struct {
+	c      *paho.Client
+	router Router
+	opts   ServerOpts
+
+	mu      sync.RWMutex
+	methods map[string]HandlerFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewServer returns a Server for opts, the methods are to be registered
+// with Handle before calling Start.
+func NewServer(opts ServerOpts) (*Server, error) {
+	if opts.Conn == nil {
+		return nil, fmt.Errorf("rpc: a connected client is required")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("rpc: a request topic is required")
+	}
+	r := opts.Router
+	if r == nil {
+		var ok bool
+		if r, ok = opts.Conn.Router.(Router); !ok {
+			return nil, fmt.Errorf("rpc: the Router of the client must implement rpc.Router, not %T", opts.Conn.Router)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		c:       opts.Conn,
+		router:  r,
+		opts:    opts,
+		methods: make(map[string]HandlerFunc),
+		ctx:     ctx,
+		cancel:  cancel,
+	}, nil
+}
+
+// Handle registers fn as the handler of the requests calling method,
+// replacing any previous one.
+func (s *Server) Handle(method string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = fn
+}
+
+// filter returns the topic filter the Server subscribes to.
+func (s *Server) filter() string {
+	if s.opts.Group != "" {
+		return fmt.Sprintf("$share/%s/%s", s.opts.Group, s.opts.Topic)
+	}
+	return s.opts.Topic
+}
+
+// Start registers the Server with the Router and subscribes to the
+// request topic.
+func (s *Server) Start(ctx context.Context) error {
+	// Publishes received through a shared subscription carry the topic
+	// they were published to, which the handler is registered for.
+	s.router.RegisterHandler(s.opts.Topic, s.handle)
+
+	_, err := s.c.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{
+			s.filter(): {QoS: s.opts.QoS},
+		},
+	})
+	if err != nil {
+		s.router.UnregisterHandler(s.opts.Topic)
+		return err
+	}
+	return nil
+}
+
+// Stop unsubscribes from the request topic and unregisters the Server from
+// the Router. The requests being handled have their context canceled and
+// Stop waits for their handlers to return.
+func (s *Server) Stop(ctx context.Context) error {
+	_, err := s.c.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{s.filter()}})
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+	// Routers may hold a lock while calling the handlers, which must
+	// return before the Server can be unregistered.
+	s.wg.Wait()
+	s.router.UnregisterHandler(s.opts.Topic)
+	return err
+}
+
+func (s *Server) handle(pb *paho.Publish, ack func() error) {
+	// The request is only acknowledged once handled, so that the server
+	// redelivers it if we go away in between.
+	defer ack()
+	s.mu.RLock()
+	stopped := s.ctx.Err() != nil
+	if !stopped {
+		s.wg.Add(1)
+	}
+	s.mu.RUnlock()
+	if !stopped {
+		defer s.wg.Done()
+	}
+
+	ctx, cancel := s.ctx, context.CancelFunc(func() {})
+	req := &Request{Publish: pb, Payload: pb.Payload, s: s}
+	if pb.Properties != nil {
+		req.Method = pb.Properties.User[MethodProperty]
+		req.ContentType = pb.Properties.ContentType
+		req.User = pb.Properties.User
+		if pb.Properties.MessageExpiry != nil {
+			// The request expires counting from its arrival, not from
+			// the time it was dispatched to us.
+			received := pb.ReceivedAt
+			if received.IsZero() {
+				received = time.Now()
+			}
+			expiry := time.Duration(*pb.Properties.MessageExpiry) * time.Second
+			ctx, cancel = context.WithDeadline(ctx, received.Add(expiry))
+		}
+	}
+	defer cancel()
+	if ctx.Err() != nil {
+		// The request expired, or we were stopped, before it could be
+		// handled.
+		s.reply(ctx, req, nil, ctx.Err())
+		return
+	}
+
+	s.mu.RLock()
+	fn, ok := s.methods[req.Method]
+	s.mu.RUnlock()
+
+	var resp *Response
+	var err error
+	if ok {
+		resp, err = fn(ctx, req)
+	} else {
+		err = &Error{Code: CodeUnknownMethod, Message: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+	s.reply(ctx, req, resp, err)
+}
+
+// reply publishes the last response to req, or err if set, unless req has
+// no Response Topic.
+func (s *Server) reply(ctx context.Context, req *Request, resp *Response, err error) {
+	pb := req.Publish
+	if pb.Properties == nil || pb.Properties.ResponseTopic == "" {
+		return
+	}
+	// The reply is sent even though the request expired or we were
+	// stopped, the requester may still be waiting for it.
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), s.c.PacketTimeout)
+		defer cancel()
+	}
+	_, _ = s.c.Publish(ctx, s.response(req, resp, err, true))
+}
+
+// response returns the Publish carrying resp, or err if set, to the
+// requester of req, numbered after the responses sent before it. end
+// marks it as the last response.
+func (s *Server) response(req *Request, resp *Response, err error, end bool) *paho.Publish {
+	pb := req.Publish
+	props := &paho.PublishProperties{
+		CorrelationData: pb.Properties.CorrelationData,
+		User:            make(map[string]string),
+	}
+	r := &paho.Publish{
+		QoS:        s.opts.QoS,
+		Topic:      pb.Properties.ResponseTopic,
+		Properties: props,
+	}
+	if err != nil {
+		props.User = replyError(err).Properties()
+	} else if resp != nil {
+		r.Payload = resp.Payload
+		props.ContentType = resp.ContentType
+		for k, v := range resp.User {
+			props.User[k] = v
+		}
+	}
+	props.User[StreamSeqProperty] = strconv.FormatUint(atomic.AddUint64(&req.seq, 1)-1, 10)
+	if end {
+		props.User[StreamEndProperty] = "true"
+	}
+	return r
+}
+
+// replyError returns the Error err is sent to the requester as.
+func replyError(err error) *Error {
+	var rerr *Error
+	switch {
+	case errors.As(err, &rerr):
+		return rerr
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCanceled, Message: err.Error()}
+	default:
+		return &Error{Code: CodeInternal, Message: err.Error()}
+	}
+}
@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// loopback serves a single client connection, sending the Publishes it
+// receives back to the client when it is subscribed to their topic. It
+// records the topic filters subscribed to in filters.
+type loopback struct {
+	mu      sync.Mutex
+	filters []string
+	topics  map[string]bool
+}
+
+func (l *loopback) Filters() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.filters...)
+}
+
+func (l *loopback) subscribed(topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.topics[topic]
+}
+
+func (l *loopback) subscribe(s *packets.Subscribe) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, filter := range s.Topics() {
+		l.filters = append(l.filters, filter)
+		topic := filter
+		if strings.HasPrefix(topic, "$share/") {
+			topic = strings.SplitN(topic, "/", 3)[2]
+		}
+		l.topics[topic] = true
+	}
+}
+
+func (l *loopback) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		recv, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch recv.Type {
+		case packets.CONNECT:
+			ca := packets.Connack{Properties: &packets.Properties{}}
+			_, err = ca.WriteTo(conn)
+		case packets.SUBSCRIBE:
+			s := recv.Content.(*packets.Subscribe)
+			l.subscribe(s)
+			sa := packets.Suback{PacketID: s.PacketID, Reasons: make([]byte, len(s.Subscriptions)), Properties: &packets.Properties{}}
+			_, err = sa.WriteTo(conn)
+		case packets.UNSUBSCRIBE:
+			u := recv.Content.(*packets.Unsubscribe)
+			ua := packets.Unsuback{PacketID: u.PacketID, Reasons: make([]byte, len(u.Topics)), Properties: &packets.Properties{}}
+			_, err = ua.WriteTo(conn)
+		case packets.PUBLISH:
+			p := recv.Content.(*packets.Publish)
+			if p.QoS > 0 {
+				pa := packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+				if _, err := pa.WriteTo(conn); err != nil {
+					return
+				}
+			}
+			if l.subscribed(p.Topic) {
+				fwd := packets.Publish{Topic: p.Topic, Payload: p.Payload, Properties: p.Properties}
+				_, err = fwd.WriteTo(conn)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// newTestServer returns a Server and a Handler sharing the same client.
+func newTestServer(t *testing.T) (*Server, *Handler, *loopback) {
+	server, conn := net.Pipe()
+	l := &loopback{topics: make(map[string]bool)}
+	go l.serve(server)
+
+	c := paho.NewClient(paho.ClientConfig{
+		Conn:   conn,
+		Router: NewStandardRouter(),
+	})
+	_, err := c.Connect(context.Background(), &paho.Connect{ClientID: "test"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Disconnect(context.Background(), &paho.Disconnect{})
+	})
+
+	s, err := NewServer(ServerOpts{Conn: c, Topic: "rpc/requests", Group: "servers", QoS: 1})
+	require.NoError(t, err)
+	h, err := NewHandler(context.Background(), HandlerOpts{Conn: c, ClientID: "test"})
+	require.NoError(t, err)
+	return s, h, l
+}
+
+func TestServer(t *testing.T) {
+	s, h, l := newTestServer(t)
+	s.Handle("upper", func(_ context.Context, req *Request) (*Response, error) {
+		return &Response{
+			Payload:     []byte(strings.ToUpper(string(req.Payload))),
+			ContentType: "text/plain",
+			User:        map[string]string{"method": req.Method},
+		}, nil
+	})
+	s.Handle("invalid", func(context.Context, *Request) (*Response, error) {
+		return nil, &Error{Code: "invalid", Message: "invalid argument"}
+	})
+	s.Handle("broken", func(context.Context, *Request) (*Response, error) {
+		return nil, errors.New("broken")
+	})
+	require.NoError(t, s.Start(context.Background()))
+	assert.Equal(t, []string{"test/responses", "$share/servers/rpc/requests"}, l.Filters())
+
+	resp, err := h.Call(context.Background(), "rpc/requests", "upper", []byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(resp.Payload))
+	assert.Equal(t, "text/plain", resp.Properties.ContentType)
+	assert.Equal(t, map[string]string{"method": "upper", StreamSeqProperty: "0", StreamEndProperty: "true"}, resp.Properties.User)
+
+	tests := map[string]*Error{
+		"invalid": {Code: "invalid", Message: "invalid argument"},
+		"broken":  {Code: CodeInternal, Message: "broken"},
+		"missing": {Code: CodeUnknownMethod, Message: `unknown method "missing"`},
+	}
+	for method, want := range tests {
+		_, err := h.Call(context.Background(), "rpc/requests", method, nil)
+		var rerr *Error
+		require.True(t, errors.As(err, &rerr), method)
+		assert.Equal(t, want, rerr, method)
+	}
+
+	require.NoError(t, s.Stop(context.Background()))
+}
+
+func TestServerMessageExpiry(t *testing.T) {
+	s, h, _ := newTestServer(t)
+	s.Handle("wait", func(ctx context.Context, _ *Request) (*Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, s.Start(context.Background()))
+
+	expiry := uint32(1)
+	start := time.Now()
+	_, err := h.Request(context.Background(), &paho.Publish{
+		Topic: "rpc/requests",
+		Properties: &paho.PublishProperties{
+			MessageExpiry: &expiry,
+			User:          map[string]string{MethodProperty: "wait"},
+		},
+	})
+	var rerr *Error
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, CodeDeadlineExceeded, rerr.Code)
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestServerRepliesUnhandled(t *testing.T) {
+	s, h, _ := newTestServer(t)
+	s.Handle("upper", func(context.Context, *Request) (*Response, error) {
+		t.Error("expired request handled")
+		return nil, nil
+	})
+	require.NoError(t, s.Start(context.Background()))
+
+	expiry := uint32(0)
+	_, err := h.Request(context.Background(), &paho.Publish{
+		Topic: "rpc/requests",
+		Properties: &paho.PublishProperties{
+			MessageExpiry: &expiry,
+			User:          map[string]string{MethodProperty: "upper"},
+		},
+	})
+	var rerr *Error
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, CodeDeadlineExceeded, rerr.Code)
+
+	// The expiry runs from the time the request was received, time spent
+	// waiting to be dispatched included.
+	expiry = 1
+	s.handle(&paho.Publish{
+		Topic:      "rpc/requests",
+		ReceivedAt: time.Now().Add(-2 * time.Second),
+		Properties: &paho.PublishProperties{
+			MessageExpiry: &expiry,
+			User:          map[string]string{MethodProperty: "upper"},
+		},
+	}, func() error { return nil })
+
+	// Requests received while the Server is stopping are refused.
+	s.mu.Lock()
+	s.cancel()
+	s.mu.Unlock()
+	_, err = h.Call(context.Background(), "rpc/requests", "upper", nil)
+	require.True(t, errors.As(err, &rerr))
+	assert.Equal(t, CodeCanceled, rerr.Code)
+	require.NoError(t, s.Stop(context.Background()))
+}
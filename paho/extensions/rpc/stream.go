@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+// StreamEndProperty is the user property marking the last response to a
+// request, Servers set it on the response returned by the HandlerFunc.
+const StreamEndProperty = "rpc-stream-end"
+
+// StreamSeqProperty is the user property numbering the responses to a
+// request from 0, so that they are passed on in the order they were sent
+// whatever the order they are routed in.
+const StreamSeqProperty = "rpc-stream-seq"
+
+// IsStreamEnd reports whether pb is the last response to its request,
+// which is the case of responses marked with StreamEndProperty and of
+// those carrying an Error.
+func IsStreamEnd(pb *paho.Publish) bool {
+	if pb.Properties == nil {
+		return false
+	}
+	if _, ok := pb.Properties.User[StreamEndProperty]; ok {
+		return true
+	}
+	_, ok := pb.Properties.User[ErrorProperty]
+	return ok
+}
+
+// Stream is the sequence of responses to a request sent with
+// Handler.Stream.
+type Stream struct {
+	// C receives the responses in the order they were sent, it is closed
+	// after the last one. Responses without StreamSeqProperty are passed on
+	// in the order they are routed.
+	C <-chan *paho.Publish
+
+	err error
+}
+
+// Err returns the reason the stream ended once C is closed: nil if the
+// last response was received, the Error it carried if any, the error of
+// the context or ErrClosed otherwise.
+func (s *Stream) Err() error {
+	return s.err
+}
+
+// Stream publishes pb as Request does and returns the Stream of its
+// responses, which ends with the response marked as the last one, see
+// IsStreamEnd, or once ctx is done. Responses routed ahead of those sent
+// before them are held back until these have been received.
+func (h *Handler) Stream(ctx context.Context, pb *paho.Publish) (*Stream, error) {
+	cID, c, err := h.send(ctx, pb)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *paho.Publish)
+	s := &Stream{C: out}
+	go func() {
+		defer close(out)
+		defer h.removeCorrelID(cID)
+
+		// emit passes resp on and reports whether the stream goes on.
+		emit := func(resp *paho.Publish) bool {
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return false
+			case <-h.done:
+				s.err = ErrClosed
+				return false
+			}
+			if IsStreamEnd(resp) {
+				s.err = ResponseError(resp)
+				return false
+			}
+			return true
+		}
+
+		// held are the responses received ahead of the next one, by
+		// sequence number.
+		var next uint64
+		held := make(map[uint64]*paho.Publish)
+		for {
+			var resp *paho.Publish
+			select {
+			case resp = <-c.responses:
+			case <-ctx.Done():
+				s.err = ctx.Err()
+				return
+			case <-h.done:
+				s.err = ErrClosed
+				return
+			}
+
+			seq, ok := streamSeq(resp)
+			if !ok {
+				if !emit(resp) {
+					return
+				}
+				continue
+			}
+			held[seq] = resp
+			for resp, ok := held[next]; ok; resp, ok = held[next] {
+				delete(held, next)
+				next++
+				if !emit(resp) {
+					return
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+// streamSeq returns the sequence number of the response pb, ok is false
+// if it has none.
+func streamSeq(pb *paho.Publish) (seq uint64, ok bool) {
+	if pb.Properties == nil {
+		return 0, false
+	}
+	v, ok := pb.Properties.User[StreamSeqProperty]
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	return seq, err == nil
+}
+
+// Gather publishes pb as Request does, usually to a topic several
+// responders subscribe to, and collects their responses until n of them
+// have been received or, when n is not positive, until ctx is done. The
+// error of ctx is only returned when fewer than n responses were received.
+// Responses carrying an Error are collected like the others, see
+// ResponseError.
+func (h *Handler) Gather(ctx context.Context, pb *paho.Publish, n int) ([]*paho.Publish, error) {
+	cID, c, err := h.send(ctx, pb)
+	if err != nil {
+		return nil, err
+	}
+	defer h.removeCorrelID(cID)
+
+	var resps []*paho.Publish
+	for n <= 0 || len(resps) < n {
+		select {
+		case resp := <-c.responses:
+			resps = append(resps, resp)
+		case <-ctx.Done():
+			if n <= 0 {
+				return resps, nil
+			}
+			return resps, ctx.Err()
+		case <-h.done:
+			return resps, ErrClosed
+		}
+	}
+	return resps, nil
+}
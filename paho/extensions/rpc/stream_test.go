@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/paho"
+)
+
+// collect returns the payloads of the responses of s once it ended.
+func collect(s *Stream) []string {
+	var payloads []string
+	for resp := range s.C {
+		payloads = append(payloads, string(resp.Payload))
+	}
+	return payloads
+}
+
+func TestHandlerStream(t *testing.T) {
+	s, h, _ := newTestServer(t)
+	s.Handle("count", func(ctx context.Context, req *Request) (*Response, error) {
+		for i := 1; i <= 20; i++ {
+			if err := req.Send(ctx, &Response{Payload: []byte(fmt.Sprint(i))}); err != nil {
+				return nil, err
+			}
+		}
+		return &Response{Payload: []byte("done")}, nil
+	})
+	s.Handle("fail", func(ctx context.Context, req *Request) (*Response, error) {
+		if err := req.Send(ctx, &Response{Payload: []byte("1")}); err != nil {
+			return nil, err
+		}
+		return nil, &Error{Code: "failed", Message: "failed"}
+	})
+	s.Handle("hang", func(ctx context.Context, _ *Request) (*Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	require.NoError(t, s.Start(context.Background()))
+	defer s.Stop(context.Background())
+
+	request := func(method string) *paho.Publish {
+		return &paho.Publish{
+			Topic:      "rpc/requests",
+			Properties: &paho.PublishProperties{User: map[string]string{MethodProperty: method}},
+		}
+	}
+
+	// The responses are routed concurrently, but passed on in order.
+	var want []string
+	for i := 1; i <= 20; i++ {
+		want = append(want, fmt.Sprint(i))
+	}
+	stream, err := h.Stream(context.Background(), request("count"))
+	require.NoError(t, err)
+	assert.Equal(t, append(want, "done"), collect(stream))
+	assert.NoError(t, stream.Err())
+
+	stream, err = h.Stream(context.Background(), request("fail"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", ""}, collect(stream))
+	var rerr *Error
+	require.True(t, errors.As(stream.Err(), &rerr))
+	assert.Equal(t, "failed", rerr.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	stream, err = h.Stream(ctx, request("hang"))
+	require.NoError(t, err)
+	assert.Empty(t, collect(stream))
+	assert.Equal(t, context.DeadlineExceeded, stream.Err())
+}
+
+func TestHandlerGather(t *testing.T) {
+	s, h, _ := newTestServer(t)
+	// The Servers share the client, so that each of them receives every
+	// request.
+	for i := 0; i < 3; i++ {
+		srv, err := NewServer(ServerOpts{Conn: s.c, Topic: "rpc/requests"})
+		require.NoError(t, err)
+		srv.Handle("ping", func(context.Context, *Request) (*Response, error) {
+			return &Response{Payload: []byte("pong")}, nil
+		})
+		require.NoError(t, srv.Start(context.Background()))
+	}
+	request := &paho.Publish{
+		Topic:      "rpc/requests",
+		Properties: &paho.PublishProperties{User: map[string]string{MethodProperty: "ping"}},
+	}
+
+	resps, err := h.Gather(context.Background(), request, 2)
+	require.NoError(t, err)
+	assert.Len(t, resps, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resps, err = h.Gather(ctx, request, 0)
+	require.NoError(t, err)
+	assert.Len(t, resps, 3)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	resps, err = h.Gather(ctx, request, 4)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, resps, 3)
+}
@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// Subscriber is implemented by the clients through which a SubIDRouter
+// sends its subscriptions, such as paho.Client and
+// autopaho.ConnectionManager.
+type Subscriber interface {
+	Subscribe(context.Context, *paho.Subscribe) (*paho.Suback, error)
+	Unsubscribe(context.Context, *paho.Unsubscribe) (*paho.Unsuback, error)
+}
+
+// SubIDRouter is a library provided implementation of a Router that
+// dispatches Publishes by the Subscription Identifiers the server sets on
+// them rather than by matching their topic, so that overlapping
+// subscriptions are never ambiguous. The server must support Subscription
+// Identifiers.
+//
+// Subscriptions are made with Subscribe, which assigns them an identifier
+// bound to a MessageHandler. Publishes carrying no known identifier are
+// routed by topic to the MessageHandlers registered with RegisterHandler.
+type SubIDRouter struct {
+	mu       sync.RWMutex
+	next     uint32
+	handlers map[uint32]MessageHandler
+	// filters maps every subscribed topic filter to the identifier of its
+	// subscription and refs counts the filters of each identifier.
+	filters map[string]uint32
+	refs    map[uint32]int
+
+	fallback *TrieRouter
+}
+
+// NewSubIDRouter instantiates and returns an instance of a SubIDRouter
+func NewSubIDRouter() *SubIDRouter {
+	return &SubIDRouter{
+		handlers: make(map[uint32]MessageHandler),
+		filters:  make(map[string]uint32),
+		refs:     make(map[uint32]int),
+		fallback: NewTrieRouter(),
+	}
+}
+
+// Subscribe sends s through c with a newly assigned Subscription
+// Identifier, which is bound to h for as long as any of the subscribed
+// topic filters remain subscribed to. s must not set a
+// SubscriptionIdentifier of its own.
+func (r *SubIDRouter) Subscribe(ctx context.Context, c Subscriber, s *paho.Subscribe, h MessageHandler) (*paho.Suback, error) {
+	var props paho.SubscribeProperties
+	if s.Properties != nil {
+		if s.Properties.SubscriptionIdentifier != nil {
+			return nil, fmt.Errorf("cannot subscribe with subID %d, subIDs are assigned by the router", *s.Properties.SubscriptionIdentifier)
+		}
+		props = *s.Properties
+	}
+
+	// The handler is bound before subscribing, as Publishes may arrive
+	// before the Suback is handed back to us.
+	r.mu.Lock()
+	id := r.assign()
+	r.handlers[id] = h
+	r.mu.Unlock()
+
+	props.SubscriptionIdentifier = &id
+	sub := *s
+	sub.Properties = &props
+	sa, err := c.Subscribe(ctx, &sub)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sa != nil {
+		for i, filter := range s.Topics() {
+			if i < len(sa.Reasons) && sa.Reasons[i] >= 0x80 {
+				continue
+			}
+			// Subscribing again to a filter replaces its subscription.
+			if old, ok := r.filters[filter]; ok {
+				r.release(old)
+			}
+			r.filters[filter] = id
+			r.refs[id]++
+		}
+	}
+	if r.refs[id] == 0 {
+		delete(r.handlers, id)
+		delete(r.refs, id)
+	}
+
+	return sa, err
+}
+
+// Unsubscribe sends u through c, unbinding the MessageHandlers of the
+// subscriptions left without any topic filter.
+func (r *SubIDRouter) Unsubscribe(ctx context.Context, c Subscriber, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	ua, err := c.Unsubscribe(ctx, u)
+	if ua == nil {
+		return ua, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, filter := range u.Topics {
+		// No subscription existed is as good as a successful unsubscribe.
+		if i < len(ua.Reasons) && ua.Reasons[i] >= 0x80 {
+			continue
+		}
+		if id, ok := r.filters[filter]; ok {
+			delete(r.filters, filter)
+			r.release(id)
+		}
+	}
+
+	return ua, err
+}
+
+// assign returns the next unused Subscription Identifier, r.mu must be
+// held.
+func (r *SubIDRouter) assign() uint32 {
+	for {
+		r.next++
+		if r.next > paho.MaxSubscriptionIdentifier {
+			r.next = 1
+		}
+		if _, ok := r.handlers[r.next]; !ok {
+			return r.next
+		}
+	}
+}
+
+// release drops a topic filter of the subscription with identifier id,
+// unbinding its handler with its last filter. r.mu must be held.
+func (r *SubIDRouter) release(id uint32) {
+	if r.refs[id]--; r.refs[id] <= 0 {
+		delete(r.refs, id)
+		delete(r.handlers, id)
+	}
+}
+
+// RegisterHandler is the library provided SubIDRouter's implementation
+// of the required interface function(), the handler is used for the
+// Publishes matching topic which carry no known Subscription Identifier.
+func (r *SubIDRouter) RegisterHandler(topic string, h MessageHandler) {
+	r.fallback.RegisterHandler(topic, h)
+}
+
+// UnregisterHandler is the library provided SubIDRouter's
+// implementation of the required interface function()
+func (r *SubIDRouter) UnregisterHandler(topic string) {
+	r.fallback.UnregisterHandler(topic)
+}
+
+// Register registers h with the fallback TrieRouter for filters, see
+// TrieRouter.Register.
+func (r *SubIDRouter) Register(h MessageHandler, filters ...string) uint64 {
+	return r.fallback.Register(h, filters...)
+}
+
+// Unregister removes the handler registered with id from the fallback
+// TrieRouter, see TrieRouter.Unregister.
+func (r *SubIDRouter) Unregister(id uint64, filters ...string) {
+	r.fallback.Unregister(id, filters...)
+}
+
+// Route is the library provided SubIDRouter's implementation
+// of the required interface function()
+func (r *SubIDRouter) Route(pb *packets.Publish, ack func() error) {
+	var handlers []MessageHandler
+	if pb.Properties != nil {
+		r.mu.RLock()
+		// The server may repeat an identifier, its handler is invoked once.
+		seen := make(map[uint32]struct{}, len(pb.Properties.SubscriptionIdentifiers))
+		for _, id := range pb.Properties.SubscriptionIdentifiers {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			if h, ok := r.handlers[id]; ok {
+				handlers = append(handlers, h)
+			}
+		}
+		r.mu.RUnlock()
+	}
+	if len(handlers) == 0 {
+		r.fallback.Route(pb, ack)
+		return
+	}
+
+	m := PublishFromPacketPublish(pb)
+	for _, h := range handlers {
+		h(m, ack)
+	}
+}
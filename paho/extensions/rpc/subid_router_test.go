@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+// fakeSubscriber acknowledges every subscription but those to the topic
+// filters in fail.
+type fakeSubscriber struct {
+	fail map[string]bool
+	ids  []uint32
+}
+
+func (f *fakeSubscriber) Subscribe(_ context.Context, s *paho.Subscribe) (*paho.Suback, error) {
+	f.ids = append(f.ids, *s.Properties.SubscriptionIdentifier)
+	sa := &paho.Suback{Properties: &paho.SubackProperties{}}
+	for _, t := range s.Topics() {
+		if f.fail[t] {
+			sa.Reasons = append(sa.Reasons, byte(paho.ReasonNotAuthorized))
+		} else {
+			sa.Reasons = append(sa.Reasons, 0)
+		}
+	}
+	return sa, nil
+}
+
+func (f *fakeSubscriber) Unsubscribe(_ context.Context, u *paho.Unsubscribe) (*paho.Unsuback, error) {
+	return &paho.Unsuback{Reasons: make([]byte, len(u.Topics)), Properties: &paho.UnsubackProperties{}}, nil
+}
+
+func publishWithIDs(topic string, ids ...uint32) *packets.Publish {
+	return &packets.Publish{
+		Topic:      topic,
+		Properties: &packets.Properties{SubscriptionIdentifiers: ids},
+	}
+}
+
+func TestSubIDRouter(t *testing.T) {
+	r := NewSubIDRouter()
+	c := &fakeSubscriber{fail: map[string]bool{"denied/#": true}}
+	calls := make(map[string]int)
+	handler := func(name string) MessageHandler {
+		return func(*paho.Publish, func() error) {
+			calls[name]++
+		}
+	}
+	r.RegisterHandler("#", handler("fallback"))
+
+	_, err := r.Subscribe(context.Background(), c, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"a/#": {QoS: 1}},
+	}, handler("wide"))
+	require.NoError(t, err)
+	_, err = r.Subscribe(context.Background(), c, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"a/b": {QoS: 1}, "c": {QoS: 1}},
+	}, handler("narrow"))
+	require.NoError(t, err)
+	_, err = r.Subscribe(context.Background(), c, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"denied/#": {QoS: 1}},
+	}, handler("denied"))
+	require.NoError(t, err)
+	require.Len(t, c.ids, 3)
+	wide, narrow, denied := c.ids[0], c.ids[1], c.ids[2]
+	assert.NotEqual(t, wide, narrow)
+
+	// Overlapping subscriptions are told apart by their identifiers.
+	r.Route(publishWithIDs("a/b", wide, narrow), nil)
+	r.Route(publishWithIDs("a/c", wide), nil)
+	assert.Equal(t, map[string]int{"wide": 2, "narrow": 1}, calls)
+
+	// The failed subscription is not bound, so it falls back on topics.
+	r.Route(publishWithIDs("denied/x", denied), nil)
+	r.Route(publishWithIDs("x"), nil)
+	assert.Equal(t, 2, calls["fallback"])
+	assert.Equal(t, 0, calls["denied"])
+
+	// The handler stays bound until all of its filters are unsubscribed.
+	_, err = r.Unsubscribe(context.Background(), c, &paho.Unsubscribe{Topics: []string{"a/b"}})
+	require.NoError(t, err)
+	r.Route(publishWithIDs("c", narrow), nil)
+	assert.Equal(t, 2, calls["narrow"])
+	_, err = r.Unsubscribe(context.Background(), c, &paho.Unsubscribe{Topics: []string{"c"}})
+	require.NoError(t, err)
+	r.Route(publishWithIDs("c", narrow), nil)
+	assert.Equal(t, 2, calls["narrow"])
+	assert.Equal(t, 3, calls["fallback"])
+
+	// Subscribing again to a filter replaces its subscription.
+	_, err = r.Subscribe(context.Background(), c, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{"a/#": {QoS: 1}},
+	}, handler("replaced"))
+	require.NoError(t, err)
+	r.Route(publishWithIDs("a/b", wide), nil)
+	assert.Equal(t, 2, calls["wide"])
+	assert.Equal(t, 4, calls["fallback"])
+
+	id := uint32(1)
+	_, err = r.Subscribe(context.Background(), c, &paho.Subscribe{
+		Properties:    &paho.SubscribeProperties{SubscriptionIdentifier: &id},
+		Subscriptions: map[string]paho.SubscribeOptions{"a/#": {QoS: 1}},
+	}, handler("own"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,251 @@
+package rpc
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+// TrieRouter is a library provided implementation of a Router that stores
+// the topic filters of its MessageHandlers in a trie, so that routing a
+// Publish takes time proportional to the depth of its topic rather than
+// to the number of registered filters.
+//
+// Filters follow the MQTT matching rules: the $share/{ShareName}/ prefix
+// of shared subscriptions is removed, and filters starting with a wildcard
+// do not match topics starting with $. Every registration is invoked once
+// per Publish, even when several of its filters match the topic, see
+// Register.
+type TrieRouter struct {
+	mu   sync.RWMutex
+	root *trieNode
+	next uint64
+	// filters holds the filters of every registration, by id, without
+	// their $share prefix.
+	filters map[uint64][]string
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	handlers []trieHandler
+}
+
+// trieHandler is a MessageHandler along with the id of its registration.
+type trieHandler struct {
+	id uint64
+	h  MessageHandler
+}
+
+// NewTrieRouter instantiates and returns an instance of a TrieRouter
+func NewTrieRouter() *TrieRouter {
+	return &TrieRouter{
+		root:    new(trieNode),
+		filters: make(map[uint64][]string),
+	}
+}
+
+// RegisterHandler is the library provided TrieRouter's
+// implementation of the required interface function(). Every call is a
+// registration of its own, a handler registered for overlapping filters
+// with several calls is invoked once per matching filter; use Register to
+// have it invoked once.
+func (r *TrieRouter) RegisterHandler(filter string, h MessageHandler) {
+	r.Register(h, filter)
+}
+
+// Register registers h for all of filters at once, h is then invoked only
+// once per Publish however many of them match its topic. The returned id
+// identifies the registration to Unregister.
+func (r *TrieRouter) Register(h MessageHandler, filters ...string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next++
+	id := r.next
+	for _, filter := range filters {
+		filter = stripShare(filter)
+		n := r.root
+		for _, level := range strings.Split(filter, "/") {
+			c := n.children[level]
+			if c == nil {
+				if n.children == nil {
+					n.children = make(map[string]*trieNode)
+				}
+				c = new(trieNode)
+				n.children[level] = c
+			}
+			n = c
+		}
+		n.handlers = append(n.handlers, trieHandler{id: id, h: h})
+		r.filters[id] = append(r.filters[id], filter)
+	}
+	return id
+}
+
+// UnregisterHandler is the library provided TrieRouter's
+// implementation of the required interface function(), it removes all
+// the handlers registered for filter.
+func (r *TrieRouter) UnregisterHandler(filter string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filter = stripShare(filter)
+	r.root.remove(strings.Split(filter, "/"), func(trieHandler) bool { return true })
+	for id, filters := range r.filters {
+		if filters = removeFilter(filters, filter); len(filters) == 0 {
+			delete(r.filters, id)
+		} else {
+			r.filters[id] = filters
+		}
+	}
+}
+
+// Unregister removes the handler registered with id from filters, or from
+// all its filters if none are given, leaving the other handlers of those
+// filters in place.
+func (r *TrieRouter) Unregister(id uint64, filters ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	drop := func(th trieHandler) bool { return th.id == id }
+	if len(filters) == 0 {
+		for _, filter := range r.filters[id] {
+			r.root.remove(strings.Split(filter, "/"), drop)
+		}
+		delete(r.filters, id)
+		return
+	}
+	for _, filter := range filters {
+		filter = stripShare(filter)
+		r.root.remove(strings.Split(filter, "/"), drop)
+		if kept := removeFilter(r.filters[id], filter); len(kept) == 0 {
+			delete(r.filters, id)
+		} else {
+			r.filters[id] = kept
+		}
+	}
+}
+
+// removeFilter returns filters without filter.
+func removeFilter(filters []string, filter string) []string {
+	kept := filters[:0]
+	for _, f := range filters {
+		if f != filter {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// remove deletes the handlers for which drop reports true from the filter
+// made of levels below n and prunes the nodes left empty. It reports
+// whether n itself is now empty.
+func (n *trieNode) remove(levels []string, drop func(trieHandler) bool) bool {
+	if len(levels) == 0 {
+		kept := n.handlers[:0]
+		for _, th := range n.handlers {
+			if !drop(th) {
+				kept = append(kept, th)
+			}
+		}
+		for i := len(kept); i < len(n.handlers); i++ {
+			n.handlers[i] = trieHandler{}
+		}
+		n.handlers = kept
+	} else if c := n.children[levels[0]]; c != nil && c.remove(levels[1:], drop) {
+		delete(n.children, levels[0])
+	}
+	return len(n.handlers) == 0 && len(n.children) == 0
+}
+
+// Route is the library provided TrieRouter's implementation
+// of the required interface function()
+func (r *TrieRouter) Route(pb *packets.Publish, ack func() error) {
+	var hs handlerSet
+	r.mu.RLock()
+	r.root.match(pb.Topic, true, &hs)
+	r.mu.RUnlock()
+
+	if len(hs.handlers) == 0 {
+		return
+	}
+	m := PublishFromPacketPublish(pb)
+	for _, h := range hs.handlers {
+		h(m, ack)
+	}
+}
+
+// match adds to hs the handlers of the filters below n matching topic,
+// root is set when n is the root of the trie.
+func (n *trieNode) match(topic string, root bool, hs *handlerSet) {
+	level, rest, last := topic, "", true
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		level, rest, last = topic[:i], topic[i+1:], false
+	}
+	// Wildcards at the first level never match topics starting with $.
+	wildcards := !root || !strings.HasPrefix(level, "$")
+
+	if wildcards {
+		if c := n.children["#"]; c != nil {
+			hs.add(c.handlers)
+		}
+	}
+	if c := n.children[level]; c != nil {
+		c.matched(rest, last, hs)
+	}
+	if wildcards {
+		if c := n.children["+"]; c != nil {
+			c.matched(rest, last, hs)
+		}
+	}
+}
+
+// matched continues the matching of a topic once n has matched one of its
+// levels, rest holding the levels following it unless it was the last.
+func (n *trieNode) matched(rest string, last bool, hs *handlerSet) {
+	if !last {
+		n.match(rest, false, hs)
+		return
+	}
+	hs.add(n.handlers)
+	// a/# also matches a.
+	if c := n.children["#"]; c != nil {
+		hs.add(c.handlers)
+	}
+}
+
+// handlerSet collects the handlers matching a Publish, once per
+// registration.
+type handlerSet struct {
+	seen     map[uint64]struct{}
+	handlers []MessageHandler
+}
+
+func (s *handlerSet) add(ths []trieHandler) {
+	for _, th := range ths {
+		if _, ok := s.seen[th.id]; ok {
+			continue
+		}
+		if s.seen == nil {
+			s.seen = make(map[uint64]struct{})
+		}
+		s.seen[th.id] = struct{}{}
+		s.handlers = append(s.handlers, th.h)
+	}
+}
+
+// stripShare removes the $share/{ShareName}/ prefix of a shared
+// subscription topic filter.
+func stripShare(filter string) string {
+	if !strings.HasPrefix(filter, "$share/") {
+		return filter
+	}
+	rest := filter[len("$share/"):]
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		// Not a valid shared subscription, keep it as is.
+		return filter
+	}
+	return rest[i+1:]
+}
@@ -0,0 +1,150 @@
+package rpc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netdata/paho.golang/packets"
+	"github.com/netdata/paho.golang/paho"
+)
+
+func TestTrieRouter(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"basic1", "a/b", "a/b", true},
+		{"basic2", "a", "a/b", false},
+		{"basic3", "a/b", "a", false},
+		{"plus1", "a/+", "a/b", true},
+		{"plus2", "+/b", "a/b", true},
+		{"plus3", "a/+/c", "a/b/c", true},
+		{"plus4", "a/+", "a/b/c", false},
+		{"plus5", "a/+", "a/", true},
+		{"plus6", "+", "/", false},
+		{"plus7", "+/+", "/", true},
+		{"hash1", "#", "a/b", true},
+		{"hash2", "a/#", "a/b", true},
+		{"hash3", "b/#", "a/b", false},
+		{"hash4", "a/#", "a", true},
+		{"hash5", "a/+/#", "a/b", true},
+		{"share1", "$share/g/a/b", "a/b", true},
+		{"share2", "$share/a/b", "a/b", false},
+		{"share3", "$share/a/b", "b", true},
+		{"dollar1", "#", "$SYS/broker", false},
+		{"dollar2", "+/broker", "$SYS/broker", false},
+		{"dollar3", "$SYS/#", "$SYS/broker", true},
+		{"dollar4", "$SYS/+", "$SYS/broker", true},
+		{"dollar5", "a/#", "a/$b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewTrieRouter()
+			var got bool
+			r.RegisterHandler(tt.filter, func(*paho.Publish, func() error) {
+				got = true
+			})
+			r.Route(&packets.Publish{Topic: tt.topic, Properties: &packets.Properties{}}, nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// counter counts the Publishes it handles, its method value is a new
+// closure every time it is taken.
+type counter struct {
+	calls int
+}
+
+func (c *counter) handle(*paho.Publish, func() error) {
+	c.calls++
+}
+
+func TestTrieRouterDedup(t *testing.T) {
+	r := NewTrieRouter()
+	var c counter
+	var separate, others int
+	r.Register(c.handle, "a/b", "a/+", "a/#", "$share/g/a/b")
+	h := func(*paho.Publish, func() error) {
+		separate++
+	}
+	// Separate registrations are invoked separately.
+	r.RegisterHandler("a/b", h)
+	r.RegisterHandler("a/+", h)
+	r.RegisterHandler("#", func(*paho.Publish, func() error) {
+		others++
+	})
+
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 1, c.calls)
+	assert.Equal(t, 2, separate)
+	assert.Equal(t, 1, others)
+}
+
+func TestTrieRouterUnregister(t *testing.T) {
+	r := NewTrieRouter()
+	var calls int
+	h := func(*paho.Publish, func() error) {
+		calls++
+	}
+	r.RegisterHandler("a/b/c", h)
+	r.RegisterHandler("a/b", h)
+
+	r.UnregisterHandler("a/b/c")
+	r.Route(&packets.Publish{Topic: "a/b/c", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 0, calls)
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 1, calls)
+
+	r.UnregisterHandler("$share/g/a/b")
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, r.root.children)
+}
+
+func TestTrieRouterUnregisterID(t *testing.T) {
+	r := NewTrieRouter()
+	var a, b counter
+	id := r.Register(a.handle, "a/b", "a/#")
+	r.Register(b.handle, "a/b")
+
+	r.Unregister(id)
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 0, a.calls)
+	assert.Equal(t, 1, b.calls)
+
+	r.UnregisterHandler("a/b")
+	assert.Empty(t, r.root.children)
+	assert.Empty(t, r.filters)
+
+	// Filters can be removed from a registration one at a time.
+	id = r.Register(a.handle, "a/b", "$share/g/a/#")
+	r.Unregister(id, "a/b")
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 1, a.calls)
+	r.Unregister(id, "$share/g/a/#")
+	r.Route(&packets.Publish{Topic: "a/b", Properties: &packets.Properties{}}, nil)
+	assert.Equal(t, 1, a.calls)
+	assert.Empty(t, r.root.children)
+	assert.Empty(t, r.filters)
+}
+
+func BenchmarkTrieRouter(b *testing.B) {
+	r := NewTrieRouter()
+	h := func(*paho.Publish, func() error) {}
+	for i := 0; i < 1000; i++ {
+		r.RegisterHandler(fmt.Sprintf("devices/%d/+/status", i), h)
+		r.RegisterHandler(fmt.Sprintf("devices/%d/sensors/#", i), h)
+	}
+	pb := &packets.Publish{Topic: "devices/500/sensors/temperature", Properties: &packets.Properties{}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Route(pb, nil)
+	}
+}
@@ -0,0 +1,369 @@
+package paho
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+const (
+	fileLogName     = "persistence.log"
+	fileRecordPut   = 'P'
+	fileRecordDel   = 'D'
+	fileHeaderLen   = 11 // op(1) + id(2) + length(4) + crc(4)
+	fileCompactSize = 256
+)
+
+var errFilePersistenceClosed = errors.New("file persistence is closed")
+
+// FilePersistence is an implementation of a Persistence that keeps the
+// ControlPackets in an append only log file so that they survive process
+// restarts. Put and Delete fsync the log before returning, Delete appending
+// a tombstone and compacting the log once dead records outnumber live ones.
+// A torn record at the end of the log, left by a crash in the middle of a
+// write, is discarded when the log is opened.
+// As the Persistence interface has no way to return errors, the first
+// error encountered is recorded and made available through Err().
+type FilePersistence struct {
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	packets map[uint16]filePersistenceEntry
+	seq     uint64
+	garbage int
+	err     error
+}
+
+type filePersistenceEntry struct {
+	seq uint64
+	cp  packets.ControlPacket
+}
+
+// NewFilePersistence returns a FilePersistence storing its log in dir,
+// which is created if needed. Any packets stored by a previous process are
+// loaded and returned by All().
+func NewFilePersistence(dir string) (*FilePersistence, error) {
+	f := &FilePersistence{dir: dir}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Open is the library provided FilePersistence's implementation of
+// the required interface function(), it reopens the log after Close.
+func (f *FilePersistence) Open() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		return
+	}
+	f.setErr(f.openLocked())
+}
+
+// Put is the library provided FilePersistence's implementation of
+// the required interface function()
+func (f *FilePersistence) Put(id uint16, cp packets.ControlPacket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		// The packet is sent all the same, it is not lost silently.
+		f.setErr(errFilePersistenceClosed)
+		return
+	}
+
+	var b bytes.Buffer
+	if _, err := cp.Content.WriteTo(&b); err != nil {
+		f.setErr(err)
+		return
+	}
+	if err := f.append(fileRecordPut, id, b.Bytes()); err != nil {
+		f.setErr(err)
+		return
+	}
+	if err := f.file.Sync(); err != nil {
+		f.setErr(err)
+		return
+	}
+
+	e, ok := f.packets[id]
+	if ok {
+		// Replacing a Publish with its Pubrel keeps its original place in
+		// the resend order.
+		f.garbage++
+	} else {
+		f.seq++
+		e.seq = f.seq
+	}
+	e.cp = cp
+	f.packets[id] = e
+}
+
+// Get is the library provided FilePersistence's implementation of
+// the required interface function()
+func (f *FilePersistence) Get(id uint16) packets.ControlPacket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.packets[id].cp
+}
+
+// All is the library provided FilePersistence's implementation of
+// the required interface function(), the packets are returned in the
+// order they were first stored.
+func (f *FilePersistence) All() []packets.ControlPacket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sorted()
+}
+
+// Delete is the library provided FilePersistence's implementation of
+// the required interface function()
+func (f *FilePersistence) Delete(id uint16) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.packets[id]; !ok || f.file == nil {
+		return
+	}
+	delete(f.packets, id)
+
+	// The deleted record and its tombstone are both dead from now on.
+	f.garbage += 2
+	if f.garbage >= fileCompactSize && f.garbage > len(f.packets) {
+		f.setErr(f.compact())
+		return
+	}
+	// A tombstone lost to a crash would have the packet resent, delivering
+	// a QoS2 message twice once its flow is complete.
+	if err := f.append(fileRecordDel, id, nil); err != nil {
+		f.setErr(err)
+		return
+	}
+	f.setErr(f.file.Sync())
+}
+
+// Close is the library provided FilePersistence's implementation of
+// the required interface function()
+func (f *FilePersistence) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return
+	}
+	f.setErr(f.file.Close())
+	f.file = nil
+	f.packets = nil
+}
+
+// Reset is the library provided FilePersistence's implementation of
+// the required interface function()
+func (f *FilePersistence) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.packets = make(map[uint16]filePersistenceEntry)
+	f.garbage = 0
+	if f.file == nil {
+		return
+	}
+	f.setErr(f.compact())
+}
+
+// Err returns the first error encountered while reading or writing the
+// log, if any.
+func (f *FilePersistence) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *FilePersistence) setErr(err error) {
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *FilePersistence) open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.openLocked()
+}
+
+func (f *FilePersistence) openLocked() error {
+	if err := os.MkdirAll(f.dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(f.dir, fileLogName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	f.packets = make(map[uint16]filePersistenceEntry)
+	f.garbage = 0
+	valid, err := f.load(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	// Drop whatever follows the last complete record, it is what is left
+	// of a write interrupted by a crash.
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+
+	return nil
+}
+
+// load replays the log in r and returns the offset of the end of the last
+// valid record.
+func (f *FilePersistence) load(r io.Reader) (int64, error) {
+	var (
+		br    = bufio.NewReader(r)
+		hdr   [fileHeaderLen]byte
+		valid int64
+	)
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, nil
+			}
+			return 0, err
+		}
+		op := hdr[0]
+		id := binary.BigEndian.Uint16(hdr[1:3])
+		n := binary.BigEndian.Uint32(hdr[3:7])
+		sum := binary.BigEndian.Uint32(hdr[7:11])
+		if (op != fileRecordPut && op != fileRecordDel) || n > 1<<28 {
+			return valid, nil
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return valid, nil
+			}
+			return 0, err
+		}
+		if crc32.ChecksumIEEE(append(hdr[:7:7], data...)) != sum {
+			return valid, nil
+		}
+
+		switch op {
+		case fileRecordPut:
+			cp, err := packets.ReadPacket(bytes.NewReader(data))
+			if err != nil {
+				return valid, nil
+			}
+			e, ok := f.packets[id]
+			if ok {
+				f.garbage++
+			} else {
+				f.seq++
+				e.seq = f.seq
+			}
+			e.cp = *cp
+			f.packets[id] = e
+		case fileRecordDel:
+			if _, ok := f.packets[id]; ok {
+				delete(f.packets, id)
+				f.garbage += 2
+			}
+		}
+		valid += int64(fileHeaderLen) + int64(n)
+	}
+}
+
+func (f *FilePersistence) append(op byte, id uint16, data []byte) error {
+	if f.file == nil {
+		return errFilePersistenceClosed
+	}
+	_, err := f.file.Write(encodeFileRecord(op, id, data))
+	return err
+}
+
+// compact rewrites the log with only the live packets, replacing the old
+// log atomically.
+func (f *FilePersistence) compact() error {
+	name := filepath.Join(f.dir, fileLogName)
+	tmp, err := os.OpenFile(name+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, cp := range f.sorted() {
+		var b bytes.Buffer
+		if _, err := cp.Content.WriteTo(&b); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := w.Write(encodeFileRecord(fileRecordPut, cp.PacketID(), b.Bytes())); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		tmp.Close()
+		return err
+	}
+	if d, err := os.Open(f.dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	f.file.Close()
+	f.file = tmp
+	f.garbage = 0
+
+	return nil
+}
+
+func (f *FilePersistence) sorted() []packets.ControlPacket {
+	entries := make([]filePersistenceEntry, 0, len(f.packets))
+	for _, e := range f.packets {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	ret := make([]packets.ControlPacket, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e.cp)
+	}
+	return ret
+}
+
+func encodeFileRecord(op byte, id uint16, data []byte) []byte {
+	b := make([]byte, fileHeaderLen+len(data))
+	b[0] = op
+	binary.BigEndian.PutUint16(b[1:3], id)
+	binary.BigEndian.PutUint32(b[3:7], uint32(len(data)))
+	copy(b[fileHeaderLen:], data)
+	sum := crc32.NewIEEE()
+	sum.Write(b[:7])
+	sum.Write(data)
+	binary.BigEndian.PutUint32(b[7:11], sum.Sum32())
+	return b
+}
@@ -0,0 +1,145 @@
+package paho
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+func testPublish(id uint16, topic string) packets.ControlPacket {
+	return packets.ControlPacket{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBLISH},
+		Content: &packets.Publish{
+			PacketID:   id,
+			QoS:        1,
+			Topic:      topic,
+			Payload:    []byte("test payload"),
+			Properties: &packets.Properties{},
+		},
+	}
+}
+
+func TestFilePersistenceRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paho")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fp, err := NewFilePersistence(dir)
+	require.NoError(t, err)
+
+	fp.Put(3, testPublish(3, "test/3"))
+	fp.Put(1, testPublish(1, "test/1"))
+	fp.Put(2, testPublish(2, "test/2"))
+	fp.Delete(1)
+	fp.Put(3, packets.ControlPacket{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBREL, Flags: 2},
+		Content:     &packets.Pubrel{PacketID: 3},
+	})
+	require.NoError(t, fp.Err())
+	fp.Close()
+
+	fp, err = NewFilePersistence(dir)
+	require.NoError(t, err)
+	defer fp.Close()
+
+	all := fp.All()
+	require.Len(t, all, 2)
+	assert.Equal(t, packets.PUBREL, all[0].Type)
+	assert.Equal(t, uint16(3), all[0].PacketID())
+	assert.Equal(t, packets.PUBLISH, all[1].Type)
+	assert.Equal(t, "test/2", all[1].Content.(*packets.Publish).Topic)
+	assert.Nil(t, fp.Get(1).Content)
+}
+
+func TestFilePersistenceClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paho")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fp, err := NewFilePersistence(dir)
+	require.NoError(t, err)
+	fp.Close()
+	require.NoError(t, fp.Err())
+
+	// A packet which could not be stored is reported.
+	fp.Put(1, testPublish(1, "test/1"))
+	assert.Equal(t, errFilePersistenceClosed, fp.Err())
+}
+
+func TestFilePersistenceTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paho")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fp, err := NewFilePersistence(dir)
+	require.NoError(t, err)
+	fp.Put(1, testPublish(1, "test/1"))
+	fp.Put(2, testPublish(2, "test/2"))
+	fp.Close()
+
+	// Cut the last record in half, as a power loss during Put would.
+	name := filepath.Join(dir, fileLogName)
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(name, fi.Size()-5))
+
+	fp, err = NewFilePersistence(dir)
+	require.NoError(t, err)
+	defer fp.Close()
+
+	all := fp.All()
+	require.Len(t, all, 1)
+	assert.Equal(t, uint16(1), all[0].PacketID())
+
+	// The log must still be usable after the torn record was dropped.
+	fp.Put(4, testPublish(4, "test/4"))
+	fp.Close()
+	fp.Open()
+	assert.Len(t, fp.All(), 2)
+	assert.NoError(t, fp.Err())
+}
+
+func TestFilePersistenceCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paho")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fp, err := NewFilePersistence(dir)
+	require.NoError(t, err)
+	defer fp.Close()
+
+	fp.Put(1, testPublish(1, "test/1"))
+	for i := uint16(2); i < 2+fileCompactSize; i++ {
+		fp.Put(i, testPublish(i, "test/x"))
+		fp.Delete(i)
+	}
+	require.NoError(t, fp.Err())
+
+	fi, err := os.Stat(filepath.Join(dir, fileLogName))
+	require.NoError(t, err)
+	assert.True(t, fi.Size() < int64(fileCompactSize)*fileHeaderLen, "log was not compacted")
+
+	fp.Reset()
+	fp.Close()
+	fp.Open()
+	assert.Len(t, fp.All(), 0)
+}
+
+func TestMemoryPersistenceAll(t *testing.T) {
+	mp := &MemoryPersistence{}
+	mp.Open()
+	mp.Put(1, testPublish(1, "test/1"))
+	mp.Put(2, testPublish(2, "test/2"))
+
+	all := mp.All()
+	require.Len(t, all, 2)
+	for _, cp := range all {
+		assert.NotNil(t, cp.Content)
+	}
+}
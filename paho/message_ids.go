@@ -3,6 +3,7 @@ package paho
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/netdata/paho.golang/packets"
@@ -27,6 +28,16 @@ type MIDService interface {
 	Clear()
 }
 
+// MIDClaimer is implemented by the MIDServices which can resend the
+// packets of a previous session, the Client requires it when the server
+// has a session for it.
+// Claim() takes a uint16 that is a messageid and a *CPContext and
+// associates them, it is used to reserve the messageids of packets
+// restored from a previous session
+type MIDClaimer interface {
+	Claim(uint16, *CPContext) error
+}
+
 // CPContext is the struct that is used to return responses to
 // ControlPackets that have them, eg: the suback to a subscribe.
 // The response packet is send down the Return channel and the
@@ -74,6 +85,19 @@ func (m *MIDs) Get(i uint16) *CPContext {
 	return m.index[i]
 }
 
+// Claim is the library provided MIDService's implementation of
+// the optional MIDClaimer interface function()
+func (m *MIDs) Claim(i uint16, c *CPContext) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.index[i]; ok {
+		return fmt.Errorf("packet id %d is already in use", i)
+	}
+	m.index[i] = c
+	return nil
+}
+
 // Free is the library provided MIDService's implementation of
 // the required interface function()
 func (m *MIDs) Free(i uint16) {
@@ -1,6 +1,7 @@
 package paho
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/netdata/paho.golang/packets"
@@ -8,12 +9,17 @@ import (
 
 // Persistence is an interface of the functions for a struct
 // that is used to persist ControlPackets.
+// The Client stores every outbound QoS1 and QoS2 Publish, and the
+// Pubrel that follows a Pubrec, until the flow is acknowledged, and
+// resends them when the server reports that the session is present.
+// A Persistence may be shared by successive Clients of the same session.
 // Open() is an initialiser to prepare the Persistence for use
 // Put() takes a uint16 which is a messageid and a ControlPacket
 // to persist against that messageid
 // Get() takes a uint16 which is a messageid and returns the
 // persisted ControlPacket from the Persistence for that messageid
-// All() returns a slice of all ControlPackets persisted
+// All() returns a slice of all ControlPackets persisted, in the order
+// their messageids were first Put, which is the order they are resent in
 // Delete() takes a uint16 which is a messageid and deletes the
 // associated stored ControlPacket from the Persistence
 // Close() closes the Persistence
@@ -29,17 +35,24 @@ type Persistence interface {
 }
 
 // MemoryPersistence is an implementation of a Persistence
-// that stores the ControlPackets in memory using a map
+// that stores the ControlPackets in memory using a map.
+// Its zero value is ready to use.
 type MemoryPersistence struct {
 	sync.RWMutex
-	packets map[uint16]packets.ControlPacket
+	packets map[uint16]memoryPersistenceEntry
+	seq     uint64
+}
+
+type memoryPersistenceEntry struct {
+	seq uint64
+	cp  packets.ControlPacket
 }
 
 // Open is the library provided MemoryPersistence's implementation of
 // the required interface function()
 func (m *MemoryPersistence) Open() {
 	m.Lock()
-	m.packets = make(map[uint16]packets.ControlPacket)
+	m.packets = make(map[uint16]memoryPersistenceEntry)
 	m.Unlock()
 }
 
@@ -47,8 +60,19 @@ func (m *MemoryPersistence) Open() {
 // the required interface function()
 func (m *MemoryPersistence) Put(id uint16, cp packets.ControlPacket) {
 	m.Lock()
-	m.packets[id] = cp
-	m.Unlock()
+	defer m.Unlock()
+	if m.packets == nil {
+		m.packets = make(map[uint16]memoryPersistenceEntry)
+	}
+	// Replacing a Publish with its Pubrel keeps its original place in
+	// the resend order.
+	e, ok := m.packets[id]
+	if !ok {
+		m.seq++
+		e.seq = m.seq
+	}
+	e.cp = cp
+	m.packets[id] = e
 }
 
 // Get is the library provided MemoryPersistence's implementation of
@@ -56,18 +80,26 @@ func (m *MemoryPersistence) Put(id uint16, cp packets.ControlPacket) {
 func (m *MemoryPersistence) Get(id uint16) packets.ControlPacket {
 	m.RLock()
 	defer m.RUnlock()
-	return m.packets[id]
+	return m.packets[id].cp
 }
 
 // All is the library provided MemoryPersistence's implementation of
-// the required interface function()
+// the required interface function(), the packets are returned in the
+// order they were first stored.
 func (m *MemoryPersistence) All() []packets.ControlPacket {
-	m.Lock()
+	m.RLock()
 	defer m.RUnlock()
-	ret := make([]packets.ControlPacket, len(m.packets))
+	entries := make([]memoryPersistenceEntry, 0, len(m.packets))
+	for _, e := range m.packets {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
 
-	for _, cp := range m.packets {
-		ret = append(ret, cp)
+	ret := make([]packets.ControlPacket, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e.cp)
 	}
 
 	return ret
@@ -93,6 +125,6 @@ func (m *MemoryPersistence) Close() {
 // the required interface function()
 func (m *MemoryPersistence) Reset() {
 	m.Lock()
-	m.packets = make(map[uint16]packets.ControlPacket)
+	m.packets = make(map[uint16]memoryPersistenceEntry)
 	m.Unlock()
 }
@@ -0,0 +1,31 @@
+package paho
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+func TestMemoryPersistenceOrder(t *testing.T) {
+	// The zero value is usable without Open.
+	var mp MemoryPersistence
+
+	for _, id := range []uint16{5, 1, 3, 2, 4} {
+		mp.Put(id, testPublish(id, "test"))
+	}
+	mp.Delete(3)
+	mp.Put(1, packets.ControlPacket{
+		FixedHeader: packets.FixedHeader{Type: packets.PUBREL, Flags: 2},
+		Content:     &packets.Pubrel{PacketID: 1},
+	})
+
+	var ids []uint16
+	for _, cp := range mp.All() {
+		ids = append(ids, cp.PacketID())
+	}
+	require.Equal(t, []uint16{5, 1, 2, 4}, ids)
+	assert.Equal(t, packets.PUBREL, mp.Get(1).Type)
+}
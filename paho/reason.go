@@ -0,0 +1,196 @@
+package paho
+
+import (
+	"fmt"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+// ReasonCode is an MQTT v5 reason code, as carried by the acknowledgement,
+// DISCONNECT and AUTH packets. Codes of 0x80 and above indicate failure.
+// A ReasonCode is also an error, so that errors returned by the Client can
+// be tested for a particular code with errors.Is.
+type ReasonCode byte
+
+// The reason codes defined by the MQTT v5 specification. Some values have
+// a different name depending on the packet, those are listed under each of
+// their names.
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonNormalDisconnection                 ReasonCode = 0x00
+	ReasonGrantedQoS0                         ReasonCode = 0x00
+	ReasonGrantedQoS1                         ReasonCode = 0x01
+	ReasonGrantedQoS2                         ReasonCode = 0x02
+	ReasonDisconnectWithWillMessage           ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReAuthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUserNameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQoSNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	ReasonSuccess:                             "success",
+	ReasonGrantedQoS1:                         "granted QoS 1",
+	ReasonGrantedQoS2:                         "granted QoS 2",
+	ReasonDisconnectWithWillMessage:           "disconnect with will message",
+	ReasonNoMatchingSubscribers:               "no matching subscribers",
+	ReasonNoSubscriptionExisted:               "no subscription existed",
+	ReasonContinueAuthentication:              "continue authentication",
+	ReasonReAuthenticate:                      "re-authenticate",
+	ReasonUnspecifiedError:                    "unspecified error",
+	ReasonMalformedPacket:                     "malformed packet",
+	ReasonProtocolError:                       "protocol error",
+	ReasonImplementationSpecificError:         "implementation specific error",
+	ReasonUnsupportedProtocolVersion:          "unsupported protocol version",
+	ReasonClientIdentifierNotValid:            "client identifier not valid",
+	ReasonBadUserNameOrPassword:               "bad user name or password",
+	ReasonNotAuthorized:                       "not authorized",
+	ReasonServerUnavailable:                   "server unavailable",
+	ReasonServerBusy:                          "server busy",
+	ReasonBanned:                              "banned",
+	ReasonServerShuttingDown:                  "server shutting down",
+	ReasonBadAuthenticationMethod:             "bad authentication method",
+	ReasonKeepAliveTimeout:                    "keep alive timeout",
+	ReasonSessionTakenOver:                    "session taken over",
+	ReasonTopicFilterInvalid:                  "topic filter invalid",
+	ReasonTopicNameInvalid:                    "topic name invalid",
+	ReasonPacketIdentifierInUse:               "packet identifier in use",
+	ReasonPacketIdentifierNotFound:            "packet identifier not found",
+	ReasonReceiveMaximumExceeded:              "receive maximum exceeded",
+	ReasonTopicAliasInvalid:                   "topic alias invalid",
+	ReasonPacketTooLarge:                      "packet too large",
+	ReasonMessageRateTooHigh:                  "message rate too high",
+	ReasonQuotaExceeded:                       "quota exceeded",
+	ReasonAdministrativeAction:                "administrative action",
+	ReasonPayloadFormatInvalid:                "payload format invalid",
+	ReasonRetainNotSupported:                  "retain not supported",
+	ReasonQoSNotSupported:                     "QoS not supported",
+	ReasonUseAnotherServer:                    "use another server",
+	ReasonServerMoved:                         "server moved",
+	ReasonSharedSubscriptionsNotSupported:     "shared subscriptions not supported",
+	ReasonConnectionRateExceeded:              "connection rate exceeded",
+	ReasonMaximumConnectTime:                  "maximum connect time",
+	ReasonSubscriptionIdentifiersNotSupported: "subscription identifiers not supported",
+	ReasonWildcardSubscriptionsNotSupported:   "wildcard subscriptions not supported",
+}
+
+// String returns the name of the reason code as given in the MQTT v5
+// specification.
+func (r ReasonCode) String() string {
+	if s, ok := reasonCodeNames[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown reason code 0x%02X", byte(r))
+}
+
+// Error implements the error interface.
+func (r ReasonCode) Error() string {
+	return r.String()
+}
+
+// IsError reports whether the reason code indicates a failure.
+func (r ReasonCode) IsError() bool {
+	return r >= 0x80
+}
+
+// ReasonError is returned when the server answers a request with a reason
+// code indicating failure. It matches its Code with errors.Is, as well as
+// any *ReasonError with the same Code and, if set, PacketType.
+type ReasonError struct {
+	// PacketType is the type of the packet that carried the reason code.
+	PacketType   packets.PacketType
+	Code         ReasonCode
+	ReasonString string
+	User         map[string]string
+}
+
+func (e *ReasonError) Error() string {
+	msg := fmt.Sprintf("%s: %s (0x%02X)", e.PacketType, e.Code, byte(e.Code))
+	if e.ReasonString != "" {
+		msg += ": " + e.ReasonString
+	}
+	return msg
+}
+
+// Unwrap returns the Code of the error.
+func (e *ReasonError) Unwrap() error {
+	return e.Code
+}
+
+// Is reports whether target is a *ReasonError for the same reason code.
+func (e *ReasonError) Is(target error) bool {
+	t, ok := target.(*ReasonError)
+	if !ok {
+		return false
+	}
+	return t.Code == e.Code && (t.PacketType == 0 || t.PacketType == e.PacketType)
+}
+
+// DisconnectError is the error a Client fails with when the server closes
+// the connection with a Disconnect. It unwraps to a *ReasonError carrying
+// the reason code of the Disconnect.
+type DisconnectError struct {
+	Disconnect *Disconnect
+}
+
+func (e *DisconnectError) Error() string {
+	code := ReasonCode(e.Disconnect.ReasonCode)
+	msg := fmt.Sprintf("received server initiated disconnect: %s (0x%02X)", code, byte(code))
+	if p := e.Disconnect.Properties; p != nil {
+		if p.ReasonString != "" {
+			msg += ": " + p.ReasonString
+		}
+		if p.ServerReference != "" {
+			msg += ", server reference " + p.ServerReference
+		}
+	}
+	return msg
+}
+
+// Unwrap returns the reason code of the Disconnect as a *ReasonError.
+func (e *DisconnectError) Unwrap() error {
+	rerr := &ReasonError{
+		PacketType: packets.DISCONNECT,
+		Code:       ReasonCode(e.Disconnect.ReasonCode),
+	}
+	if p := e.Disconnect.Properties; p != nil {
+		rerr.ReasonString = p.ReasonString
+		rerr.User = p.User
+	}
+	return rerr
+}
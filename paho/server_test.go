@@ -25,6 +25,7 @@ type testServer struct {
 	clientConn net.Conn
 	stop       chan struct{}
 	responses  map[packets.PacketType]packets.Packet
+	onReceive  func(*packets.ControlPacket)
 }
 
 func newTestServer() *testServer {
@@ -45,6 +46,12 @@ func (t *testServer) SetResponse(pt packets.PacketType, p packets.Packet) {
 	t.responses[pt] = p
 }
 
+// OnReceive sets a function called with every packet the server reads,
+// it must be set before Run is called.
+func (t *testServer) OnReceive(fn func(*packets.ControlPacket)) {
+	t.onReceive = fn
+}
+
 func (t *testServer) SendPacket(p packets.Packet) error {
 	_, err := p.WriteTo(t.conn)
 
@@ -68,6 +75,9 @@ func (t *testServer) Run() {
 				return
 			}
 			log.Println("test server received a control packet:", recv.Type)
+			if t.onReceive != nil {
+				t.onReceive(recv)
+			}
 			switch recv.Type {
 			case packets.CONNECT:
 				log.Println("received connect", recv.Content.(*packets.Connect))
@@ -0,0 +1,73 @@
+package paho
+
+import (
+	"container/list"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+// topicAliases assigns outbound topic aliases on behalf of the user when
+// ClientConfig.AutoTopicAlias is set. It is only used from the writer
+// goroutine, so that aliases are registered in the same order that the
+// Publishes go on the wire, and needs no locking.
+// Once all of the aliases allowed by the server are in use the least
+// recently used one is reassigned to the new topic.
+type topicAliases struct {
+	max    uint16
+	topics map[string]*list.Element
+	lru    *list.List // of *topicAlias, most recently used at the front.
+}
+
+type topicAlias struct {
+	topic string
+	alias uint16
+}
+
+func newTopicAliases(max uint16) *topicAliases {
+	return &topicAliases{
+		max:    max,
+		topics: make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+// apply returns the Publish to be sent in place of pb. The first Publish to
+// a topic carries both the topic and its newly assigned alias, later ones
+// carry an empty topic and the alias only. pb itself is left unchanged as
+// it may still be held by Persistence for resending on a new connection,
+// where the aliases of this one are no longer valid.
+func (t *topicAliases) apply(pb *packets.Publish) *packets.Publish {
+	if t.max == 0 || pb.Topic == "" {
+		return pb
+	}
+
+	var props packets.Properties
+	if pb.Properties != nil {
+		props = *pb.Properties
+	}
+	cp := *pb
+	cp.Properties = &props
+
+	if e, ok := t.topics[pb.Topic]; ok {
+		t.lru.MoveToFront(e)
+		alias := e.Value.(*topicAlias).alias
+		props.TopicAlias = &alias
+		cp.Topic = ""
+		return &cp
+	}
+
+	var a *topicAlias
+	if t.lru.Len() < int(t.max) {
+		a = &topicAlias{alias: uint16(t.lru.Len()) + 1}
+	} else {
+		e := t.lru.Back()
+		a = t.lru.Remove(e).(*topicAlias)
+		delete(t.topics, a.topic)
+	}
+	a.topic = pb.Topic
+	t.topics[pb.Topic] = t.lru.PushFront(a)
+
+	alias := a.alias
+	props.TopicAlias = &alias
+	return &cp
+}
@@ -0,0 +1,200 @@
+// Package transport creates the network connections used by a paho.Client
+// from URLs describing the server to connect to.
+//
+// The supported schemes are mqtt and tcp for plain TCP connections, mqtts,
+// ssl and tls for TLS connections, unix for Unix domain sockets and ws and
+// wss for WebSocket connections, plain and over TLS. When no port is given
+// the standard ports, 1883, 8883, 80 and 443, are used.
+//
+// Connections other than to unix sockets may be made through HTTP CONNECT
+// or SOCKS5 proxies, see Dialer.Proxy and ProxyFromEnvironment.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Dialer holds the options used to establish connections, the zero value
+// is ready to use.
+type Dialer struct {
+	// TLSConfig is used for the TLS based schemes. If it does not set a
+	// ServerName the host from the URL is used.
+	TLSConfig *tls.Config
+	// ProxyTLSConfig is used for the TLS connection to https proxies. If
+	// it does not set a ServerName the host from the proxy URL is used.
+	ProxyTLSConfig *tls.Config
+	// Timeout limits the time spent establishing a connection, including
+	// the TLS handshake. Zero means that only the context passed to Dial
+	// applies.
+	Timeout time.Duration
+	// NetDialer is used to open the underlying network connections, a
+	// zero net.Dialer is used if it is nil.
+	NetDialer *net.Dialer
+	// DialContext, if set, is used instead of NetDialer to open the
+	// underlying network connections.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Proxy returns the proxy to connect through to reach the server at
+	// the given URL, or nil to connect directly; ProxyFromEnvironment
+	// can be used here. Proxies are not used for unix sockets.
+	Proxy func(*url.URL) (*url.URL, error)
+	// WebSocketHeader holds additional HTTP headers, such as
+	// Authorization, sent in the WebSocket opening handshake.
+	WebSocketHeader http.Header
+}
+
+// Dial connects to the server at u using a zero Dialer.
+func Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	return new(Dialer).Dial(ctx, u)
+}
+
+// ParseURL parses a server URL. A bare host:port, as accepted by net.Dial,
+// is taken to be an mqtt:// URL.
+func ParseURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "mqtt://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("transport: invalid server URL: %w", err)
+	}
+	return u, nil
+}
+
+// Dial connects to the server at u, the returned connection is ready for
+// the MQTT CONNECT to be sent.
+func (d *Dialer) Dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cf context.CancelFunc
+		ctx, cf = context.WithTimeout(ctx, d.Timeout)
+		defer cf()
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "mqtt", "tcp":
+		return d.dial(ctx, u, "tcp", hostPort(u, "1883"))
+	case "mqtts", "ssl", "tls":
+		conn, err := d.dial(ctx, u, "tcp", hostPort(u, "8883"))
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, conn, func() (net.Conn, error) {
+			return handshake(conn, d.TLSConfig, u.Hostname())
+		})
+	case "unix":
+		path := u.Host + u.Path
+		if path == "" {
+			path = u.Opaque
+		}
+		return d.dialDirect(ctx, "unix", path)
+	case "ws":
+		conn, err := d.dial(ctx, u, "tcp", hostPort(u, "80"))
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, conn, func() (net.Conn, error) {
+			return d.websocket(conn, u)
+		})
+	case "wss":
+		conn, err := d.dial(ctx, u, "tcp", hostPort(u, "443"))
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, conn, func() (net.Conn, error) {
+			tc, err := handshake(conn, d.TLSConfig, u.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			return d.websocket(tc, u)
+		})
+	default:
+		return nil, fmt.Errorf("transport: unsupported scheme %q", u.Scheme)
+	}
+}
+
+// dial connects to addr, the address of the server at u, through the proxy
+// returned by Proxy if any.
+func (d *Dialer) dial(ctx context.Context, u *url.URL, network, addr string) (net.Conn, error) {
+	if d.Proxy != nil {
+		p, err := d.Proxy(u)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return d.dialProxy(ctx, p, addr)
+		}
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.DialContext != nil {
+		return d.DialContext(ctx, network, addr)
+	}
+	nd := d.NetDialer
+	if nd == nil {
+		nd = new(net.Dialer)
+	}
+	return nd.DialContext(ctx, network, addr)
+}
+
+// handshake performs the TLS client handshake over conn with a copy of
+// base, host being the ServerName if base sets none.
+func handshake(conn net.Conn, base *tls.Config, host string) (net.Conn, error) {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// withContext runs the handshake fn over conn, closing conn if it fails or
+// ctx is done first.
+func withContext(ctx context.Context, conn net.Conn, fn func() (net.Conn, error)) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := fn()
+		done <- result{c, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			conn.Close()
+			return nil, r.err
+		}
+		return r.conn, nil
+	case <-ctx.Done():
+		conn.Close()
+		<-done
+		return nil, ctx.Err()
+	}
+}
+
+// hostPort returns the address of the server at u, adding port if the URL
+// does not contain one.
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
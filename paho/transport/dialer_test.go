@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// acceptOne accepts a single connection on l and echoes what it reads.
+func acceptOne(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestParseURL(t *testing.T) {
+	u, err := ParseURL("127.0.0.1:1883")
+	require.NoError(t, err)
+	assert.Equal(t, "mqtt", u.Scheme)
+	assert.Equal(t, "127.0.0.1:1883", u.Host)
+
+	u, err = ParseURL("wss://broker.example.com/mqtt")
+	require.NoError(t, err)
+	assert.Equal(t, "wss", u.Scheme)
+	assert.Equal(t, "/mqtt", u.Path)
+}
+
+func TestHostPort(t *testing.T) {
+	u, _ := url.Parse("mqtts://broker.example.com")
+	assert.Equal(t, "broker.example.com:8883", hostPort(u, "8883"))
+	u, _ = url.Parse("tcp://[::1]:1884")
+	assert.Equal(t, "[::1]:1884", hostPort(u, "1883"))
+}
+
+func TestDialTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go acceptOne(l)
+
+	var dials int
+	d := &Dialer{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}
+	conn, err := d.Dial(context.Background(), &url.URL{Scheme: "tcp", Host: l.Addr().String()})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, 1, dials)
+	assertEcho(t, conn)
+}
+
+func TestDialTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	u := &url.URL{Scheme: "mqtts", Host: ts.Listener.Addr().String()}
+
+	_, err := Dial(context.Background(), u)
+	assert.Error(t, err)
+
+	d := &Dialer{TLSConfig: &tls.Config{RootCAs: roots}}
+	conn, err := d.Dial(context.Background(), u)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.True(t, conn.(*tls.Conn).ConnectionState().HandshakeComplete)
+	assert.Equal(t, "", d.TLSConfig.ServerName)
+}
+
+func TestDialTLSTimeout(t *testing.T) {
+	// A server that accepts the connection but never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = ioutil.ReadAll(conn)
+	}()
+
+	d := &Dialer{Timeout: 50 * time.Millisecond}
+	_, err = d.Dial(context.Background(), &url.URL{Scheme: "ssl", Host: l.Addr().String()})
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDialUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mqtt.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+	go acceptOne(l)
+
+	conn, err := Dial(context.Background(), &url.URL{Scheme: "unix", Path: path})
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestDialUnsupportedScheme(t *testing.T) {
+	_, err := Dial(context.Background(), &url.URL{Scheme: "http", Host: "127.0.0.1:80"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,334 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ProxyFromEnvironment returns the proxy to use to reach the server at u,
+// as set by the environment variables HTTPS_PROXY for the TLS based
+// schemes, HTTP_PROXY for ws and ALL_PROXY for all of them, or their
+// lowercase versions. Hosts listed in NO_PROXY are reached directly.
+// A nil URL is returned when no proxy should be used. It can be used as
+// Dialer.Proxy.
+func ProxyFromEnvironment(u *url.URL) (*url.URL, error) {
+	return proxyFromEnvironment(u, getenv)
+}
+
+func getenv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(key))
+}
+
+func proxyFromEnvironment(u *url.URL, getenv func(string) string) (*url.URL, error) {
+	var proxy string
+	switch strings.ToLower(u.Scheme) {
+	case "mqtts", "ssl", "tls", "wss":
+		proxy = getenv("HTTPS_PROXY")
+	case "ws":
+		proxy = getenv("HTTP_PROXY")
+	case "unix":
+		return nil, nil
+	}
+	if proxy == "" {
+		proxy = getenv("ALL_PROXY")
+	}
+	if proxy == "" || noProxy(u, getenv("NO_PROXY")) {
+		return nil, nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	p, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("transport: invalid proxy URL: %w", err)
+	}
+	return p, nil
+}
+
+// noProxy reports whether the server at u is excluded from proxying by the
+// NO_PROXY list, which holds host names, domain suffixes, IP addresses and
+// CIDR ranges, optionally with a port, or * to exclude everything.
+func noProxy(u *url.URL, list string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	ip := net.ParseIP(host)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if e == "*" {
+			return true
+		}
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			if p != port {
+				continue
+			}
+			e = h
+		}
+		if ip != nil {
+			if eip := net.ParseIP(strings.Trim(e, "[]")); eip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		e = strings.TrimPrefix(e, "*")
+		if host == strings.TrimPrefix(e, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(e, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy opens a tunnel to addr through the proxy at p, which may be an
+// http, https, socks5 or socks5h proxy. The host of addr is resolved
+// locally for socks5 proxies and by the proxy for the others. Credentials
+// in p are used to authenticate with the proxy.
+func (d *Dialer) dialProxy(ctx context.Context, p *url.URL, addr string) (net.Conn, error) {
+	switch strings.ToLower(p.Scheme) {
+	case "http", "https":
+		port := "80"
+		if strings.ToLower(p.Scheme) == "https" {
+			port = "443"
+		}
+		conn, err := d.dialDirect(ctx, "tcp", hostPort(p, port))
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, conn, func() (net.Conn, error) {
+			if strings.ToLower(p.Scheme) != "https" {
+				return httpConnect(conn, p, addr)
+			}
+			tc, err := handshake(conn, d.ProxyTLSConfig, p.Hostname())
+			if err != nil {
+				return nil, err
+			}
+			return httpConnect(tc, p, addr)
+		})
+	case "socks5", "socks5h":
+		if strings.ToLower(p.Scheme) == "socks5" {
+			var err error
+			if addr, err = d.resolve(ctx, addr); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := d.dialDirect(ctx, "tcp", hostPort(p, "1080"))
+		if err != nil {
+			return nil, err
+		}
+		return withContext(ctx, conn, func() (net.Conn, error) {
+			return socks5Connect(conn, p, addr)
+		})
+	default:
+		return nil, fmt.Errorf("transport: unsupported proxy scheme %q", p.Scheme)
+	}
+}
+
+// httpConnect asks the HTTP proxy at the other end of conn for a tunnel to
+// addr with the CONNECT method.
+func httpConnect(conn net.Conn, p *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		pw, _ := p.User.Password()
+		req.SetBasicAuth(p.User.Username(), pw)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("transport: proxy refused connection to %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// resolve replaces the host name of addr with one of its IP addresses,
+// preferring IPv4 ones, using the Resolver of NetDialer if set.
+func (d *Dialer) resolve(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return addr, nil
+	}
+	r := net.DefaultResolver
+	if d.NetDialer != nil && d.NetDialer.Resolver != nil {
+		r = d.NetDialer.Resolver
+	}
+	ips, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("transport: no addresses found for %s", host)
+	}
+	ip := ips[0].IP
+	for _, a := range ips {
+		if a.IP.To4() != nil {
+			ip = a.IP
+			break
+		}
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+// bufferedConn is a net.Conn whose first bytes have already been read into
+// a buffer.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// The SOCKS version 5 protocol values, as defined by RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5UserPassword = 0x02
+	socks5NoAcceptable = 0xFF
+	socks5CmdConnect   = 0x01
+	socks5IPv4         = 0x01
+	socks5DomainName   = 0x03
+	socks5IPv6         = 0x04
+)
+
+// socks5Connect asks the SOCKS5 proxy at the other end of conn to connect
+// to addr, authenticating with the username and password from p if set.
+func socks5Connect(conn net.Conn, p *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("transport: invalid port %q", portStr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if p.User != nil {
+		methods = append(methods, socks5UserPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return nil, err
+	}
+	var b [2]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return nil, err
+	}
+	if b[0] != socks5Version {
+		return nil, fmt.Errorf("transport: unexpected SOCKS version %d", b[0])
+	}
+	switch b[1] {
+	case socks5NoAuth:
+	case socks5UserPassword:
+		if p.User == nil {
+			return nil, fmt.Errorf("transport: SOCKS5 proxy requires authentication")
+		}
+		user := p.User.Username()
+		pw, _ := p.User.Password()
+		if len(user) > 255 || len(pw) > 255 {
+			return nil, fmt.Errorf("transport: SOCKS5 username or password too long")
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pw)))
+		req = append(req, pw...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, err
+		}
+		if b[1] != 0x00 {
+			return nil, fmt.Errorf("transport: SOCKS5 proxy authentication failed")
+		}
+	case socks5NoAcceptable:
+		return nil, fmt.Errorf("transport: no acceptable SOCKS5 authentication method")
+	default:
+		return nil, fmt.Errorf("transport: unexpected SOCKS5 authentication method %d", b[1])
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("transport: host name too long for SOCKS5")
+		}
+		req = append(req, socks5DomainName, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5IPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5IPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var resp [4]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return nil, err
+	}
+	if resp[1] != 0x00 {
+		return nil, fmt.Errorf("transport: SOCKS5 proxy refused connection to %s: reply code %d", addr, resp[1])
+	}
+	// Skip the bound address and port, they are of no use to us.
+	var skip int
+	switch resp[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5DomainName:
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return nil, err
+		}
+		skip = int(b[0]) + 2
+	default:
+		return nil, fmt.Errorf("transport: unexpected SOCKS5 address type %d", resp[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
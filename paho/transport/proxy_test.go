@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// splice copies data between a and b until either of them is closed.
+func splice(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
+
+// httpProxy returns a stand-in HTTP proxy that only allows CONNECT
+// requests authenticated as user:secret, answering them with status.
+func httpProxy(status string) func(net.Listener) {
+	return func(l net.Listener) {
+		serveHTTPProxy(l, status)
+	}
+}
+
+func serveHTTPProxy(l net.Listener, status string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			req.Header.Set("Authorization", req.Header.Get("Proxy-Authorization"))
+			if user, pw, ok := req.BasicAuth(); !ok || user != "user" || pw != "secret" {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				conn.Close()
+				return
+			}
+			if req.Method != http.MethodConnect {
+				io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+				conn.Close()
+				return
+			}
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				conn.Close()
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 "+status+"\r\n\r\n")
+			splice(conn, target)
+		}()
+	}
+}
+
+// socks5Proxy returns a stand-in SOCKS5 proxy that requires the
+// user:secret credentials, the address types of the connect requests it
+// receives are sent on atyps.
+func socks5Proxy(atyps chan<- byte) func(net.Listener) {
+	return func(l net.Listener) {
+		serveSOCKS5Proxy(l, atyps)
+	}
+}
+
+func serveSOCKS5Proxy(l net.Listener, atyps chan<- byte) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			target, err := socks5Accept(conn, atyps)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			splice(conn, target)
+		}()
+	}
+}
+
+func socks5Accept(conn net.Conn, atyps chan<- byte) (net.Conn, error) {
+	b := make([]byte, 257)
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, b[:b[1]]); err != nil {
+		return nil, err
+	}
+	conn.Write([]byte{socks5Version, socks5UserPassword})
+
+	// Username/password negotiation.
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	user := make([]byte, b[1])
+	io.ReadFull(conn, user)
+	io.ReadFull(conn, b[:1])
+	pw := make([]byte, b[0])
+	io.ReadFull(conn, pw)
+	if string(user) != "user" || string(pw) != "secret" {
+		conn.Write([]byte{0x01, 0x01})
+		return nil, io.EOF
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	// Connect request.
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return nil, err
+	}
+	atyps <- b[3]
+	var host string
+	switch b[3] {
+	case socks5IPv4:
+		io.ReadFull(conn, b[:4])
+		host = net.IP(b[:4]).String()
+	case socks5IPv6:
+		io.ReadFull(conn, b[:16])
+		host = net.IP(b[:16]).String()
+	case socks5DomainName:
+		io.ReadFull(conn, b[:1])
+		name := make([]byte, b[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return nil, io.EOF
+	}
+	io.ReadFull(conn, b[:2])
+	port := binary.BigEndian.Uint16(b[:2])
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{socks5Version, 0x05, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{socks5Version, 0x00, 0x00, socks5IPv4, 127, 0, 0, 1, 0, 0})
+	return target, nil
+}
+
+// testProxy dials an echo server through the proxy served on proxy, with
+// wrong credentials first and then with the right ones.
+func testProxy(t *testing.T, d *Dialer, scheme string, proxy net.Listener, serve func(net.Listener)) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go acceptOne(target)
+
+	defer proxy.Close()
+	go serve(proxy)
+
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	u := &url.URL{Scheme: "mqtt", Host: net.JoinHostPort("localhost", port)}
+
+	d.Proxy = func(*url.URL) (*url.URL, error) {
+		return &url.URL{Scheme: scheme, User: url.UserPassword("user", "wrong"), Host: proxy.Addr().String()}, nil
+	}
+	_, err = d.Dial(context.Background(), u)
+	assert.Error(t, err)
+
+	d.Proxy = func(*url.URL) (*url.URL, error) {
+		return &url.URL{Scheme: scheme, User: url.UserPassword("user", "secret"), Host: proxy.Addr().String()}, nil
+	}
+	conn, err := d.Dial(context.Background(), u)
+	require.NoError(t, err)
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return l
+}
+
+func TestDialHTTPProxy(t *testing.T) {
+	testProxy(t, new(Dialer), "http", listen(t), httpProxy("200 Connection established"))
+	// Any 2xx status establishes the tunnel.
+	testProxy(t, new(Dialer), "http", listen(t), httpProxy("204 No Content"))
+}
+
+func TestDialHTTPSProxy(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	// The server's TLSConfig is not used for the proxy.
+	d := &Dialer{
+		TLSConfig:      &tls.Config{ServerName: "broker.invalid"},
+		ProxyTLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"},
+	}
+	testProxy(t, d, "https", tls.NewListener(listen(t), ts.TLS), httpProxy("200 Connection established"))
+}
+
+func TestDialSOCKS5Proxy(t *testing.T) {
+	// The host is resolved locally for socks5 and by the proxy for
+	// socks5h.
+	atyps := make(chan byte, 1)
+	testProxy(t, new(Dialer), "socks5", listen(t), socks5Proxy(atyps))
+	assert.Equal(t, byte(socks5IPv4), <-atyps)
+
+	testProxy(t, new(Dialer), "socks5h", listen(t), socks5Proxy(atyps))
+	assert.Equal(t, byte(socks5DomainName), <-atyps)
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	env := map[string]string{
+		"HTTPS_PROXY": "secure-proxy:3128",
+		"ALL_PROXY":   "socks5://socks-proxy:1080",
+		"NO_PROXY":    "localhost, .internal.example.com,10.0.0.0/8,broker:1884",
+	}
+	getenv := func(k string) string {
+		return env[k]
+	}
+
+	tests := []struct {
+		server string
+		proxy  string
+	}{
+		{"mqtts://broker.example.com", "http://secure-proxy:3128"},
+		{"wss://broker.example.com", "http://secure-proxy:3128"},
+		{"mqtt://broker.example.com", "socks5://socks-proxy:1080"},
+		{"ws://broker.example.com", "socks5://socks-proxy:1080"},
+		{"mqtt://localhost:1883", ""},
+		{"mqtt://a.internal.example.com", ""},
+		{"mqtt://internal.example.com", ""},
+		{"mqtt://10.1.2.3:1883", ""},
+		{"mqtt://broker:1884", ""},
+		{"mqtt://broker:1883", "socks5://socks-proxy:1080"},
+		{"unix:///var/run/mqtt.sock", ""},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.server)
+		require.NoError(t, err)
+		p, err := proxyFromEnvironment(u, getenv)
+		require.NoError(t, err)
+		if tt.proxy == "" {
+			assert.Nil(t, p, tt.server)
+		} else if assert.NotNil(t, p, tt.server) {
+			assert.Equal(t, tt.proxy, p.String(), tt.server)
+		}
+	}
+
+	env["NO_PROXY"] = "*"
+	p, err := proxyFromEnvironment(&url.URL{Scheme: "mqtts", Host: "broker.example.com"}, getenv)
+	require.NoError(t, err)
+	assert.Nil(t, p)
+}
@@ -0,0 +1,290 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The WebSocket opcodes, as defined by RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+const (
+	wsProtocol = "mqtt"
+	wsGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var errWSClosed = errors.New("transport: websocket closed")
+
+// wsHeader is the header of a single WebSocket frame.
+type wsHeader struct {
+	fin    bool
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length int64
+}
+
+// wsConn is a net.Conn sending and receiving MQTT over a WebSocket
+// connection. Every Write is sent as one binary message, on Read the
+// payloads of the received messages are returned as a continuous stream so
+// that packets may span messages, or messages contain several packets.
+type wsConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	// remaining is the number of payload bytes of the current frame that
+	// are yet to be read, mask and pos are used to unmask them.
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	pos       int
+
+	wmu    sync.Mutex
+	closed bool
+}
+
+// websocket performs the client side of the WebSocket opening handshake
+// for u over conn, asking for the mqtt subprotocol.
+func (d *Dialer) websocket(conn net.Conn, u *url.URL) (net.Conn, error) {
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	ru := *u
+	switch ru.Scheme {
+	case "ws":
+		ru.Scheme = "http"
+	case "wss":
+		ru.Scheme = "https"
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &ru,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range d.WebSocketHeader {
+		req.Header[k] = v
+	}
+	if u.User != nil && req.Header.Get("Authorization") == "" {
+		pw, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), pw)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", wsProtocol)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("transport: websocket handshake failed: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(resp.Header.Get("Connection")), "upgrade") {
+		return nil, fmt.Errorf("transport: websocket handshake failed: connection not upgraded")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, fmt.Errorf("transport: websocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != wsProtocol {
+		return nil, fmt.Errorf("transport: websocket handshake failed: server did not select the %s subprotocol", wsProtocol)
+	}
+
+	return &wsConn{Conn: conn, br: br}, nil
+}
+
+// Read returns the payload of the binary messages received, answering
+// pings and close frames as they are encountered.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		h, err := readWSHeader(c.br)
+		if err != nil {
+			return 0, err
+		}
+		switch h.opcode {
+		case wsBinary, wsContinuation:
+			c.remaining, c.masked, c.mask, c.pos = h.length, h.masked, h.mask, 0
+		case wsPing, wsPong, wsClose:
+			if h.length > 125 {
+				return 0, fmt.Errorf("transport: websocket control frame too long")
+			}
+			payload := make([]byte, h.length)
+			if _, err := io.ReadFull(c.br, payload); err != nil {
+				return 0, err
+			}
+			if h.masked {
+				unmask(payload, h.mask, 0)
+			}
+			switch h.opcode {
+			case wsPing:
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return 0, err
+				}
+			case wsClose:
+				_ = c.writeFrame(wsClose, payload)
+				return 0, io.EOF
+			}
+		default:
+			_ = c.writeFrame(wsClose, []byte{0x03, 0xEB}) // 1003, unsupported data.
+			return 0, fmt.Errorf("transport: unexpected websocket opcode %d", h.opcode)
+		}
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.br.Read(b)
+	if c.masked {
+		c.pos = unmask(b[:n], c.mask, c.pos)
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Write sends b as a single binary message, paho.Client writes each
+// packet with a single Write.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a normal closure frame before closing the connection.
+func (c *wsConn) Close() error {
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000, normal closure.
+	return c.Conn.Close()
+}
+
+// writeFrame sends a single masked frame, as all client frames must be.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return errWSClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(encodeWSFrame(opcode, payload, &mask))
+	return err
+}
+
+func readWSHeader(r io.Reader) (wsHeader, error) {
+	var (
+		h wsHeader
+		b [8]byte
+	)
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.opcode = b[0] & 0x0F
+	h.masked = b[1]&0x80 != 0
+	switch l := b[1] & 0x7F; l {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, err
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]))
+		if h.length < 0 {
+			return h, fmt.Errorf("transport: invalid websocket frame length")
+		}
+	default:
+		h.length = int64(l)
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// encodeWSFrame returns a complete final frame carrying payload, masked
+// with mask unless it is nil.
+func encodeWSFrame(opcode byte, payload []byte, mask *[4]byte) []byte {
+	b := make([]byte, 0, 14+len(payload))
+	b = append(b, 0x80|opcode)
+
+	var m byte
+	if mask != nil {
+		m = 0x80
+	}
+	switch l := len(payload); {
+	case l <= 125:
+		b = append(b, m|byte(l))
+	case l <= 0xFFFF:
+		b = append(b, m|126, byte(l>>8), byte(l))
+	default:
+		b = append(b, m|127)
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(l))
+		b = append(b, n[:]...)
+	}
+
+	if mask == nil {
+		return append(b, payload...)
+	}
+	b = append(b, mask[:]...)
+	start := len(b)
+	b = append(b, payload...)
+	unmask(b[start:], *mask, 0)
+	return b
+}
+
+// unmask applies mask to b, which starts at offset pos of the frame
+// payload, and returns the offset following b.
+func unmask(b []byte, mask [4]byte, pos int) int {
+	for i := range b {
+		b[i] ^= mask[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
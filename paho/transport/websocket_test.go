@@ -0,0 +1,188 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netdata/paho.golang/packets"
+)
+
+// wsTestServer accepts a WebSocket connection and answers every MQTT packet
+// it receives with a PINGRESP, split over two messages with a ping frame in
+// between them.
+type wsTestServer struct {
+	t       *testing.T
+	headers chan http.Header
+	pongs   chan []byte
+}
+
+func newWSTestServer(t *testing.T) *wsTestServer {
+	return &wsTestServer{
+		t:       t,
+		headers: make(chan http.Header, 1),
+		pongs:   make(chan []byte, 1),
+	}
+}
+
+func (s *wsTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.headers <- r.Header
+	if r.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		http.Error(w, "mqtt subprotocol required", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	brw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+	brw.WriteString("Sec-WebSocket-Protocol: mqtt\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	r2 := &wsReader{br: brw.Reader, pongs: s.pongs}
+	for {
+		if _, err := packets.ReadPacket(r2); err != nil {
+			return
+		}
+		conn.Write(encodeWSFrame(wsBinary, []byte{byte(packets.PINGRESP) << 4}, nil))
+		conn.Write(encodeWSFrame(wsPing, []byte("hello"), nil))
+		conn.Write(encodeWSFrame(wsContinuation, []byte{0}, nil))
+	}
+}
+
+// wsReader reads the payload of the masked frames sent by the client.
+type wsReader struct {
+	br        *bufio.Reader
+	remaining int64
+	mask      [4]byte
+	pos       int
+	pongs     chan []byte
+}
+
+func (r *wsReader) Read(b []byte) (int, error) {
+	for r.remaining == 0 {
+		h, err := readWSHeader(r.br)
+		if err != nil {
+			return 0, err
+		}
+		if !h.masked {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if h.opcode == wsPong {
+			payload := make([]byte, h.length)
+			io.ReadFull(r.br, payload)
+			unmask(payload, h.mask, 0)
+			r.pongs <- payload
+			continue
+		}
+		r.remaining, r.mask, r.pos = h.length, h.mask, 0
+	}
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.br.Read(b)
+	r.pos = unmask(b[:n], r.mask, r.pos)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func testWebSocket(t *testing.T, conn net.Conn, pongs chan []byte) {
+	for i := 0; i < 2; i++ {
+		_, err := packets.NewControlPacket(packets.PINGREQ).WriteTo(conn)
+		require.NoError(t, err)
+		cp, err := packets.ReadPacket(conn)
+		require.NoError(t, err)
+		assert.Equal(t, packets.PINGRESP, cp.Type)
+		assert.Equal(t, "hello", string(<-pongs))
+	}
+}
+
+func TestDialWebSocket(t *testing.T) {
+	s := newWSTestServer(t)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u.Scheme = "ws"
+	u.Path = "/mqtt"
+
+	d := &Dialer{
+		WebSocketHeader: http.Header{"Authorization": []string{"Bearer token"}},
+	}
+	conn, err := d.Dial(context.Background(), u)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "Bearer token", (<-s.headers).Get("Authorization"))
+	testWebSocket(t, conn, s.pongs)
+}
+
+func TestDialWebSocketTLS(t *testing.T) {
+	s := newWSTestServer(t)
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u.Scheme = "wss"
+	u.User = url.UserPassword("user", "secret")
+
+	d := &Dialer{TLSConfig: &tls.Config{RootCAs: roots}}
+	conn, err := d.Dial(context.Background(), u)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	user, pass, ok := (&http.Request{Header: <-s.headers}).BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "secret", pass)
+	testWebSocket(t, conn, s.pongs)
+}
+
+func TestDialWebSocketRejected(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u.Scheme = "ws"
+
+	_, err = Dial(context.Background(), u)
+	assert.Error(t, err)
+}
+
+func TestEncodeWSFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		payload := make([]byte, n)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		mask := [4]byte{1, 2, 3, 4}
+		b := encodeWSFrame(wsBinary, payload, &mask)
+
+		r := &wsReader{br: bufio.NewReader(bytes.NewReader(b))}
+		got := make([]byte, n)
+		_, err := io.ReadFull(r, got)
+		require.NoError(t, err)
+		assert.Equal(t, payload, got)
+	}
+}